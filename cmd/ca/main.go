@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nees/omail/internal/auth"
+	"github.com/nees/omail/internal/crypto"
+)
+
+const usage = `Usage: omail-ca <command> [flags]
+
+Commands:
+  init   Create a CA key pair
+  issue  Issue a client certificate
+  show   Print the contents of a certificate
+
+Run "omail-ca <command> -h" for the flags of a command.
+`
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "init":
+		initCA(os.Args[2:])
+	case "issue":
+		issue(os.Args[2:])
+	case "show":
+		show(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// initCA creates a CA key pair
+func initCA(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	keyFile := fs.String("key", "ca.key", "Write the CA private key to this file")
+	pubFile := fs.String("pub", "ca.pub", "Write the CA public key to this file (give it to the server with -ca)")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*keyFile); err == nil {
+		log.Fatalf("%s already exists; refusing to overwrite a CA key", *keyFile)
+	}
+
+	pub, priv, err := auth.GenerateCA()
+	if err != nil {
+		log.Fatalf("Failed to generate CA key: %v", err)
+	}
+	if err := auth.WriteCAPrivateKey(*keyFile, priv); err != nil {
+		log.Fatalf("Failed to write CA private key: %v", err)
+	}
+	if err := auth.WriteCAPublicKey(*pubFile, pub); err != nil {
+		log.Fatalf("Failed to write CA public key: %v", err)
+	}
+
+	fmt.Printf("CA private key written to %s\n", *keyFile)
+	fmt.Printf("CA public key written to %s\n", *pubFile)
+}
+
+// issue signs a certificate for a client public key
+func issue(args []string) {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	caKeyFile := fs.String("ca-key", "ca.key", "CA private key file")
+	name := fs.String("name", "", "Name of the certificate holder (required)")
+	pubKey := fs.String("pub", "", "Client public key, base64 (required; see omail-keygen)")
+	tunnelIP := fs.String("tunnel-ip", "", "Tunnel IP address assigned to the client")
+	networks := fs.String("networks", "", "Comma-separated CIDR networks the client may reach (empty for no restriction)")
+	valid := fs.Duration("valid", 90*24*time.Hour, "How long the certificate is valid")
+	out := fs.String("out", "", "Write the certificate to this file (default <name>.crt)")
+	fs.Parse(args)
+
+	if *name == "" {
+		log.Fatal("Name is required. Use -name flag")
+	}
+	if *pubKey == "" {
+		log.Fatal("Client public key is required. Use -pub flag")
+	}
+	if *valid <= 0 {
+		log.Fatal("Validity must be positive")
+	}
+
+	ca, err := auth.LoadCAPrivateKey(*caKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load CA private key: %v", err)
+	}
+
+	key, err := crypto.ParsePublicKey(*pubKey)
+	if err != nil {
+		log.Fatalf("Invalid client public key: %v", err)
+	}
+
+	now := time.Now()
+	cert := &auth.Certificate{
+		Name:      *name,
+		PublicKey: key,
+		// Allow for clocks running slightly behind
+		NotBefore: now.Add(-5 * time.Minute),
+		NotAfter:  now.Add(*valid),
+	}
+
+	if *tunnelIP != "" {
+		cert.TunnelIP = net.ParseIP(*tunnelIP)
+		if cert.TunnelIP == nil {
+			log.Fatalf("Invalid tunnel IP: %s", *tunnelIP)
+		}
+	}
+
+	if *networks != "" {
+		for _, s := range strings.Split(*networks, ",") {
+			s = strings.TrimSpace(s)
+			_, network, err := net.ParseCIDR(s)
+			if err != nil {
+				log.Fatalf("Invalid CIDR network %s: %v", s, err)
+			}
+			cert.AllowedNetworks = append(cert.AllowedNetworks, network)
+		}
+	}
+
+	if err := cert.Sign(ca); err != nil {
+		log.Fatalf("Failed to sign certificate: %v", err)
+	}
+
+	path := *out
+	if path == "" {
+		path = *name + ".crt"
+	}
+	if err := auth.WriteCertificate(path, cert); err != nil {
+		log.Fatalf("Failed to write certificate: %v", err)
+	}
+
+	fmt.Printf("Issued certificate %d for %s, valid until %s, written to %s\n",
+		cert.Serial, cert.Name, cert.NotAfter.Format(time.RFC3339), path)
+}
+
+// show prints a certificate
+func show(args []string) {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: omail-ca show <certificate file>")
+	}
+
+	cert, err := auth.LoadCertificate(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	fmt.Printf("Serial:     %d\n", cert.Serial)
+	fmt.Printf("Name:       %s\n", cert.Name)
+	fmt.Printf("Public key: %s\n", cert.PublicKey)
+	if cert.TunnelIP != nil {
+		fmt.Printf("Tunnel IP:  %s\n", cert.TunnelIP)
+	}
+	for _, network := range cert.AllowedNetworks {
+		fmt.Printf("Network:    %s\n", network)
+	}
+	fmt.Printf("Not before: %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("Not after:  %s\n", cert.NotAfter.Format(time.RFC3339))
+}
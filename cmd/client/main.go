@@ -1,32 +1,59 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/nees/omail/internal/auth"
 	"github.com/nees/omail/internal/client"
+	"github.com/nees/omail/internal/crypto"
 )
 
 func main() {
-	serverAddr := flag.String("server", "", "Server address (e.g., server.com:51820)")
-	password := flag.String("password", "", "Encryption password (required)")
+	serverAddr := flag.String("server", "", "Comma-separated server endpoints (e.g., eu.server.com:51820,us.server.com:51820); the fastest is used and the others are failed over to")
+	keyFile := flag.String("key", "", "File containing the client private key (required)")
+	serverKeyStr := flag.String("server-key", "", "Server public key, base64 (required)")
 	tunName := flag.String("tun", "omail0", "TUN interface name")
-	tunIP := flag.String("tun-ip", "10.0.0.2", "TUN interface IP address")
-	tunNetmask := flag.String("tun-netmask", "255.255.255.0", "TUN interface netmask")
-	mtu := flag.Int("mtu", 1500, "MTU size")
+	tunIP := flag.String("tun-ip", "", "TUN interface IP address, if the server does not assign one")
+	tunNetmask := flag.String("tun-netmask", "", "TUN interface netmask, if the server does not push one (default 255.255.255.0)")
+	mtu := flag.Int("mtu", 0, "MTU size (default: pushed by the server, else 1500)")
 	splitTunnelStr := flag.String("split-tunnel", "", "Comma-separated list of CIDR networks for split tunneling (empty for full tunnel)")
+	pskFile := flag.String("psk-file", "", "File containing the pre-shared key this client shares with the server")
+	certFile := flag.String("cert", "", "Client certificate issued by the server's CA (see omail-ca)")
+	username := flag.String("user", "", "User name for password authentication")
+	passwordFile := flag.String("password-file", "", "File containing the password for -user")
+	otp := flag.String("otp", "", "One-time code for users with a second factor (prompted for on the terminal if needed and not given)")
+	kex := flag.String("kex", "hybrid", "Key exchange: hybrid (ML-KEM-768 + X25519 when the server supports it), classic or hybrid-only")
+	ciphers := flag.String("ciphers", "", "Comma-separated cipher suites in order of preference (aes-256-gcm, chacha20-poly1305, xchacha20-poly1305; default depends on CPU)")
+	killSwitch := flag.Bool("kill-switch", false, "Block all traffic outside the tunnel except to the server, also while reconnecting (Linux, needs nft)")
 	flag.Parse()
 
 	if *serverAddr == "" {
 		log.Fatal("Server address is required. Use -server flag")
 	}
-	if *password == "" {
-		log.Fatal("Password is required. Use -password flag")
+	if *keyFile == "" {
+		log.Fatal("Private key is required. Use -key flag")
+	}
+	if *serverKeyStr == "" {
+		log.Fatal("Server public key is required. Use -server-key flag")
+	}
+
+	privateKey, err := crypto.LoadPrivateKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load private key: %v", err)
+	}
+
+	serverKey, err := crypto.ParsePublicKey(*serverKeyStr)
+	if err != nil {
+		log.Fatalf("Invalid server public key: %v", err)
 	}
 
 	// Parse split tunnel networks
@@ -43,14 +70,74 @@ func main() {
 		}
 	}
 
+	var psk crypto.PresharedKey
+	if *pskFile != "" {
+		psk, err = crypto.LoadPresharedKey(*pskFile)
+		if err != nil {
+			log.Fatalf("Failed to load pre-shared key: %v", err)
+		}
+	}
+
+	var cert *auth.Certificate
+	if *certFile != "" {
+		cert, err = auth.LoadCertificate(*certFile)
+		if err != nil {
+			log.Fatalf("Failed to load certificate: %v", err)
+		}
+		if time.Now().After(cert.NotAfter) {
+			log.Printf("Warning: certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	var password string
+	if *username != "" {
+		if *passwordFile == "" {
+			log.Fatal("Password file is required with -user. Use -password-file flag")
+		}
+		data, err := os.ReadFile(*passwordFile)
+		if err != nil {
+			log.Fatalf("Failed to read password file: %v", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	kexMode, err := crypto.ParseKEXMode(*kex)
+	if err != nil {
+		log.Fatalf("Invalid -kex: %v", err)
+	}
+
+	var suites []crypto.CipherSuite
+	if *ciphers != "" {
+		suites, err = crypto.ParseSuites(*ciphers)
+		if err != nil {
+			log.Fatalf("Invalid -ciphers: %v", err)
+		}
+	}
+
+	var serverAddrs []string
+	for _, s := range strings.Split(*serverAddr, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			serverAddrs = append(serverAddrs, s)
+		}
+	}
+
 	config := client.Config{
-		ServerAddr:  *serverAddr,
-		Password:    *password,
-		TUNName:     *tunName,
-		TUNIP:       *tunIP,
-		TUNNetmask:  *tunNetmask,
-		MTU:         *mtu,
-		SplitTunnel: splitTunnel,
+		ServerAddrs:  serverAddrs,
+		PrivateKey:   privateKey,
+		ServerKey:    serverKey,
+		PresharedKey: psk,
+		KEXMode:      kexMode,
+		CipherSuites: suites,
+		Certificate:  cert,
+		Username:     *username,
+		Password:     password,
+		OTP:          otpSource(*otp),
+		TUNName:      *tunName,
+		TUNIP:        *tunIP,
+		TUNNetmask:   *tunNetmask,
+		MTU:          *mtu,
+		SplitTunnel:  splitTunnel,
+		KillSwitch:   *killSwitch,
 	}
 
 	cli, err := client.NewClient(config)
@@ -62,13 +149,42 @@ func main() {
 		log.Fatalf("Failed to connect: %v", err)
 	}
 
-	// Wait for interrupt signal
+	// Wait for interrupt signal or for the server to end the session
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	<-sigChan
+	select {
+	case <-sigChan:
+	case <-cli.Done():
+		// Only the user lifts the kill switch, so that a session the server
+		// ends does not let traffic out in the clear
+		log.Printf("Session ended: %v", cli.Err())
+		if err := cli.Close(); err != nil {
+			log.Printf("Error closing client: %v", err)
+		}
+		if *killSwitch {
+			log.Println("Kill switch stays active until the client is started again and disconnected")
+		}
+		os.Exit(1)
+	}
 
 	log.Println("Disconnecting from VPN server...")
 	if err := cli.Disconnect(); err != nil {
 		log.Printf("Error disconnecting: %v", err)
 	}
 }
+
+// otpSource returns the one-time code given with -otp, or prompts for one on
+// the terminal
+func otpSource(code string) func() (string, error) {
+	return func() (string, error) {
+		if code != "" {
+			return code, nil
+		}
+		fmt.Fprint(os.Stderr, "One-time code: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+}
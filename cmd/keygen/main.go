@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nees/omail/internal/auth"
+	"github.com/nees/omail/internal/crypto"
+)
+
+func main() {
+	out := flag.String("out", "", "Write a new private key to this file")
+	pub := flag.String("pub", "", "Print the public key of the private key in this file")
+	genPSK := flag.Bool("genpsk", false, "Print a new random pre-shared key")
+	genTOTP := flag.String("gentotp", "", "Print a new TOTP secret for this user name and its authenticator app URI")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from stdin and print its Argon2id hash")
+	argonMemory := flag.Uint("argon-memory", uint(crypto.DefaultPasswordParams.Memory), "Argon2id memory cost in KiB")
+	argonTime := flag.Uint("argon-time", uint(crypto.DefaultPasswordParams.Time), "Argon2id time cost (passes)")
+	argonThreads := flag.Uint("argon-threads", uint(crypto.DefaultPasswordParams.Threads), "Argon2id parallelism")
+	flag.Parse()
+
+	switch {
+	case *genPSK:
+		psk, err := crypto.GeneratePresharedKey()
+		if err != nil {
+			log.Fatalf("Failed to generate pre-shared key: %v", err)
+		}
+		fmt.Println(psk)
+
+	case *genTOTP != "":
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			log.Fatalf("Failed to generate TOTP secret: %v", err)
+		}
+		fmt.Println(secret)
+		fmt.Println(auth.TOTPURI(secret, "omail", *genTOTP))
+
+	case *hashPassword:
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			log.Fatal("Password must not be empty")
+		}
+
+		params := crypto.PasswordParams{
+			Memory:  uint32(*argonMemory),
+			Time:    uint32(*argonTime),
+			Threads: uint8(*argonThreads),
+		}
+		hash, err := crypto.HashPassword(password, params)
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(hash)
+
+	case *pub != "":
+		key, err := crypto.LoadPrivateKey(*pub)
+		if err != nil {
+			log.Fatalf("Failed to load private key: %v", err)
+		}
+		fmt.Println(key.PublicKey())
+
+	case *out != "":
+		key, err := crypto.GeneratePrivateKey()
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		if err := os.WriteFile(*out, []byte(key.String()+"\n"), 0600); err != nil {
+			log.Fatalf("Failed to write private key: %v", err)
+		}
+		fmt.Println(key.PublicKey())
+
+	default:
+		log.Fatal("Use -out to generate a key pair, -pub to print a public key, -genpsk to generate a pre-shared key, -gentotp to generate a TOTP secret or -hash-password to hash a password")
+	}
+}
@@ -1,35 +1,153 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/nees/omail/internal/auth"
+	"github.com/nees/omail/internal/crypto"
 	"github.com/nees/omail/internal/server"
 )
 
 func main() {
 	address := flag.String("address", ":51820", "Server listen address")
-	password := flag.String("password", "", "Encryption password (required)")
+	keyFile := flag.String("key", "", "File containing the server private key (required)")
+	peersFile := flag.String("peers", "", "File listing allowed client public keys, one per line")
+	usersFile := flag.String("users", "", "JSON user database with credentials, tunnel IPs and allowed routes")
+	caFile := flag.String("ca", "", "CA public key file; clients with a certificate signed by it may connect (see omail-ca)")
+	revocationFile := flag.String("revocation-list", "", "File of revoked certificate serials, client keys and users; reloaded when it changes")
+	passwdFile := flag.String("passwd-file", "", "File of user:hash lines with Argon2id password hashes (see omail-keygen -hash-password)")
 	tunName := flag.String("tun", "omail0", "TUN interface name")
 	tunIP := flag.String("tun-ip", "10.0.0.1", "TUN interface IP address")
 	tunNetmask := flag.String("tun-netmask", "255.255.255.0", "TUN interface netmask")
 	mtu := flag.Int("mtu", 1500, "MTU size")
+	pool := flag.String("pool", "", "CIDR network to lease tunnel IPs from to clients without a fixed one (e.g. 10.0.0.0/24)")
+	leaseFile := flag.String("lease-file", "", "File keeping address leases across restarts")
+	leaseTime := flag.Duration("lease-time", server.DefaultLeaseTime, "How long a client's leased address stays reserved after its last session")
+	pushRoutesStr := flag.String("push-routes", "", "Comma-separated CIDR networks clients route through the tunnel (empty for all traffic; users' allowed routes take precedence)")
+	pushDNSStr := flag.String("push-dns", "", "Comma-separated DNS servers for clients to use while connected")
+	pskFile := flag.String("psk-file", "", "File of \"<client public key> <pre-shared key>\" lines (see omail-keygen -genpsk)")
+	handshakeLoad := flag.Int("handshake-load", server.DefaultHandshakeLoad, "Handshake inits per second above which clients must echo a cookie")
+	kex := flag.String("kex", "hybrid", "Key exchange: hybrid (ML-KEM-768 + X25519 when the client supports it), classic or hybrid-only")
+	ciphers := flag.String("ciphers", "", "Comma-separated cipher suites in order of preference (aes-256-gcm, chacha20-poly1305, xchacha20-poly1305; default depends on CPU)")
 	flag.Parse()
 
-	if *password == "" {
-		log.Fatal("Password is required. Use -password flag")
+	if *keyFile == "" {
+		log.Fatal("Private key is required. Use -key flag")
+	}
+	if *peersFile == "" && *usersFile == "" && *passwdFile == "" && *caFile == "" {
+		log.Fatal("Allowed peers, users or a CA are required. Use -peers, -users, -passwd-file or -ca flag")
+	}
+
+	privateKey, err := crypto.LoadPrivateKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load private key: %v", err)
+	}
+
+	var peers []crypto.PublicKey
+	if *peersFile != "" {
+		peers, err = crypto.LoadPublicKeys(*peersFile)
+		if err != nil {
+			log.Fatalf("Failed to load peers: %v", err)
+		}
+	}
+
+	var passwords map[string]string
+	if *passwdFile != "" {
+		passwords, err = crypto.LoadPasswordHashes(*passwdFile)
+		if err != nil {
+			log.Fatalf("Failed to load password file: %v", err)
+		}
+	}
+
+	var caKeys []ed25519.PublicKey
+	if *caFile != "" {
+		caKeys, err = auth.LoadCAPublicKeys(*caFile)
+		if err != nil {
+			log.Fatalf("Failed to load CA: %v", err)
+		}
+	}
+
+	var psks map[crypto.PublicKey]crypto.PresharedKey
+	if *pskFile != "" {
+		psks, err = crypto.LoadPresharedKeys(*pskFile)
+		if err != nil {
+			log.Fatalf("Failed to load pre-shared keys: %v", err)
+		}
+	}
+
+	kexMode, err := crypto.ParseKEXMode(*kex)
+	if err != nil {
+		log.Fatalf("Invalid -kex: %v", err)
+	}
+
+	var suites []crypto.CipherSuite
+	if *ciphers != "" {
+		suites, err = crypto.ParseSuites(*ciphers)
+		if err != nil {
+			log.Fatalf("Invalid -ciphers: %v", err)
+		}
+	}
+
+	var addressPool *net.IPNet
+	if *pool != "" {
+		_, addressPool, err = net.ParseCIDR(*pool)
+		if err != nil {
+			log.Fatalf("Invalid -pool: %v", err)
+		}
+	}
+
+	var pushRoutes []*net.IPNet
+	if *pushRoutesStr != "" {
+		for _, s := range strings.Split(*pushRoutesStr, ",") {
+			s = strings.TrimSpace(s)
+			_, network, err := net.ParseCIDR(s)
+			if err != nil {
+				log.Fatalf("Invalid CIDR network %s: %v", s, err)
+			}
+			pushRoutes = append(pushRoutes, network)
+		}
+	}
+
+	var pushDNS []net.IP
+	if *pushDNSStr != "" {
+		for _, s := range strings.Split(*pushDNSStr, ",") {
+			s = strings.TrimSpace(s)
+			ip := net.ParseIP(s)
+			if ip == nil {
+				log.Fatalf("Invalid DNS server: %s", s)
+			}
+			pushDNS = append(pushDNS, ip)
+		}
 	}
 
 	config := server.Config{
-		Address:    *address,
-		Password:   *password,
-		TUNName:    *tunName,
-		TUNIP:      *tunIP,
-		TUNNetmask: *tunNetmask,
-		MTU:        *mtu,
+		Address:        *address,
+		PrivateKey:     privateKey,
+		Peers:          peers,
+		UsersFile:      *usersFile,
+		CAKeys:         caKeys,
+		RevocationFile: *revocationFile,
+		Passwords:      passwords,
+		PresharedKeys:  psks,
+		KEXMode:        kexMode,
+		CipherSuites:   suites,
+		HandshakeLoad:  *handshakeLoad,
+		AddressPool:    addressPool,
+		LeaseFile:      *leaseFile,
+		LeaseTime:      *leaseTime,
+		PushRoutes:     pushRoutes,
+		PushDNS:        pushDNS,
+		TUNName:        *tunName,
+		TUNIP:          *tunIP,
+		TUNNetmask:     *tunNetmask,
+		MTU:            *mtu,
 	}
 
 	srv, err := server.NewServer(config)
@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # Quick VPN Connection Script
-# Usage: sudo ./connect.sh [server-ip] [password]
+# Usage: sudo ./connect.sh [server-ip] [server-public-key]
 
 set -e
 
@@ -22,11 +22,10 @@ if [ -z "$SERVER_IP" ]; then
     read -p "Enter server IP or hostname: " SERVER_IP
 fi
 
-# Get password
-PASSWORD="${2:-${VPN_PASSWORD}}"
-if [ -z "$PASSWORD" ]; then
-    read -sp "Enter VPN password: " PASSWORD
-    echo ""
+# Get the server's public key
+SERVER_KEY="${2:-${VPN_SERVER_KEY}}"
+if [ -z "$SERVER_KEY" ]; then
+    read -p "Enter server public key: " SERVER_KEY
 fi
 
 # Get client IP (auto-increment)
@@ -47,6 +46,15 @@ if [ ! -f "$CLIENT_BINARY" ]; then
     exit 1
 fi
 
+# The client's key must be in the server's peers file
+KEY_FILE="${VPN_KEY_FILE:-$SCRIPT_DIR/keys/client.key}"
+if [ ! -f "$KEY_FILE" ]; then
+    echo -e "${RED}Error: Client key not found at $KEY_FILE${NC}"
+    echo "Generate one with: $SCRIPT_DIR/bin/omail-keygen -out $KEY_FILE"
+    echo "and add the public key it prints to the server's peers file"
+    exit 1
+fi
+
 # Clean up any existing TUN interface
 if ip link show omail0 &>/dev/null; then
     echo -e "${YELLOW}Cleaning up existing omail0 interface...${NC}"
@@ -60,5 +68,6 @@ echo ""
 
 exec "$CLIENT_BINARY" \
     -server "$SERVER_IP:51820" \
-    -password "$PASSWORD" \
+    -key "$KEY_FILE" \
+    -server-key "$SERVER_KEY" \
     -tun-ip "$CLIENT_IP"
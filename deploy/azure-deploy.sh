@@ -19,14 +19,6 @@ if [ "$EUID" -ne 0 ]; then
     exit 1
 fi
 
-# Generate secure password
-VPN_PASSWORD=$(openssl rand -base64 32)
-echo -e "${YELLOW}Generated VPN Password:${NC} $VPN_PASSWORD"
-echo "$VPN_PASSWORD" > /root/vpn-password.txt
-chmod 600 /root/vpn-password.txt
-echo -e "${GREEN}Password saved to /root/vpn-password.txt${NC}"
-echo ""
-
 # Update system
 echo -e "${YELLOW}Updating system packages...${NC}"
 apt update -qq
@@ -96,9 +88,21 @@ fi
 echo -e "${YELLOW}Deploying VPN server with Docker...${NC}"
 cd /opt/omail
 
+# Generate the server key; docker-compose mounts keys/ at /etc/omail
+mkdir -p keys
+chmod 700 keys
+if [ ! -f keys/server.key ]; then
+    echo -e "${YELLOW}Generating server key...${NC}"
+    docker run --rm -v /opt/omail:/src -w /src golang:1.24-alpine \
+        go run ./cmd/keygen -out keys/server.key > keys/server.pub
+fi
+touch keys/peers
+SERVER_KEY=$(cat keys/server.pub)
+echo -e "${GREEN}Server public key:${NC} $SERVER_KEY"
+echo ""
+
 # Create .env file
 cat > .env << EOF
-VPN_PASSWORD=$VPN_PASSWORD
 VPN_ADDRESS=:51820
 VPN_TUN_NAME=omail0
 VPN_TUN_IP=10.0.0.1
@@ -121,15 +125,15 @@ if docker-compose ps | grep -q "Up"; then
     echo "Server Information:"
     echo "  Public IP: $(curl -s ifconfig.me)"
     echo "  Port: 51820/UDP"
-    echo "  Password: $VPN_PASSWORD"
-    echo "  Password file: /root/vpn-password.txt"
+    echo "  Server public key: $SERVER_KEY"
+    echo "  Allowed client keys: /opt/omail/keys/peers"
     echo ""
     echo "View logs: docker-compose -f /opt/omail/docker-compose.yml logs -f vpn-server"
     echo "Stop server: docker-compose -f /opt/omail/docker-compose.yml down"
     echo ""
     echo -e "${YELLOW}Don't forget to:${NC}"
     echo "  1. Configure Azure NSG to allow UDP 51820"
-    echo "  2. Save the password securely"
+    echo "  2. Add each client's public key to /opt/omail/keys/peers and restart the server"
     echo "  3. Test connection from client"
 else
     echo -e "${RED}✗ VPN Server failed to start${NC}"
@@ -18,9 +18,22 @@ if [ "$EUID" -ne 0 ]; then
     exit 1
 fi
 
-# Get VPN password
-read -sp "Enter VPN password: " VPN_PASSWORD
-echo ""
+# Get the server key and the allowed client keys
+read -p "Server private key [/etc/omail/server.key]: " KEY_FILE
+KEY_FILE=${KEY_FILE:-/etc/omail/server.key}
+read -p "Allowed client public keys [/etc/omail/peers]: " PEERS_FILE
+PEERS_FILE=${PEERS_FILE:-/etc/omail/peers}
+
+if [ ! -f "$KEY_FILE" ]; then
+    echo "Error: Server key not found at $KEY_FILE"
+    echo "Generate one with: omail-keygen -out $KEY_FILE"
+    exit 1
+fi
+if [ ! -f "$PEERS_FILE" ]; then
+    echo "Error: Peers file not found at $PEERS_FILE"
+    echo "Add each client with: omail-keygen -pub client.key >> $PEERS_FILE"
+    exit 1
+fi
 
 # Get server IP (optional, for binding)
 read -p "Server IP (leave empty for all interfaces): " SERVER_IP
@@ -50,7 +63,8 @@ After=network.target
 Type=simple
 ExecStart=$BINARY_PATH \\
     -address $ADDRESS \\
-    -password $VPN_PASSWORD \\
+    -key $KEY_FILE \\
+    -peers $PEERS_FILE \\
     -tun omail0 \\
     -tun-ip 10.0.0.1 \\
     -tun-netmask 255.255.255.0 \\
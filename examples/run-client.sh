@@ -6,7 +6,8 @@ set -e
 
 # Configuration
 SERVER="${VPN_SERVER:-localhost:51820}"
-PASSWORD="${VPN_PASSWORD:-changeme123}"
+KEY_FILE="${VPN_KEY_FILE:-./keys/client.key}"
+SERVER_KEY="${VPN_SERVER_KEY:-$(cat ./keys/server.pub 2>/dev/null)}"
 TUN_NAME="${VPN_TUN_NAME:-omail0}"
 TUN_IP="${VPN_CLIENT_TUN_IP:-10.0.0.2}"
 TUN_NETMASK="${VPN_TUN_NETMASK:-255.255.255.0}"
@@ -43,7 +44,8 @@ fi
 # Build command
 CMD="./bin/omail-client \
     -server \"$SERVER\" \
-    -password \"$PASSWORD\" \
+    -key \"$KEY_FILE\" \
+    -server-key \"$SERVER_KEY\" \
     -tun \"$TUN_NAME\" \
     -tun-ip \"$TUN_IP\" \
     -tun-netmask \"$TUN_NETMASK\" \
@@ -5,7 +5,8 @@
 set -e
 
 # Configuration
-PASSWORD="${VPN_PASSWORD:-changeme123}"
+KEY_FILE="${VPN_KEY_FILE:-./keys/server.key}"
+PEERS_FILE="${VPN_PEERS_FILE:-./keys/peers}"
 ADDRESS="${VPN_ADDRESS:-:51820}"
 TUN_NAME="${VPN_TUN_NAME:-omail0}"
 TUN_IP="${VPN_TUN_IP:-10.0.0.1}"
@@ -37,7 +38,8 @@ fi
 # Run server
 exec ./bin/omail-server \
     -address "$ADDRESS" \
-    -password "$PASSWORD" \
+    -key "$KEY_FILE" \
+    -peers "$PEERS_FILE" \
     -tun "$TUN_NAME" \
     -tun-ip "$TUN_IP" \
     -tun-netmask "$TUN_NETMASK" \
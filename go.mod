@@ -1,6 +1,6 @@
 module github.com/nees/omail
 
-go 1.21
+go 1.24
 
 require (
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
@@ -3,6 +3,6 @@ echo "Installing Go on Arch Linux..."
 echo "Please run: sudo pacman -S go"
 echo ""
 echo "Or download manually:"
-echo "wget https://go.dev/dl/go1.21.6.linux-amd64.tar.gz"
-echo "sudo tar -C /usr/local -xzf go1.21.6.linux-amd64.tar.gz"
+echo "wget https://go.dev/dl/go1.24.6.linux-amd64.tar.gz"
+echo "sudo tar -C /usr/local -xzf go1.24.6.linux-amd64.tar.gz"
 echo "export PATH=\$PATH:/usr/local/go/bin"
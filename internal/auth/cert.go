@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+const (
+	certPEMType         = "OMAIL CERTIFICATE"
+	caPrivateKeyPEMType = "OMAIL CA PRIVATE KEY"
+	caPublicKeyPEMType  = "OMAIL CA PUBLIC KEY"
+)
+
+// certSignatureContext is prepended to certificate bodies before signing so
+// that a CA key's signatures cannot be confused with any other use of it
+var certSignatureContext = []byte("omail client certificate v1\x00")
+
+// Certificate binds a client's static public key to a name, a tunnel IP and
+// the networks it may reach, for a limited time, under a CA's signature.
+type Certificate struct {
+	Serial          uint64
+	Name            string
+	PublicKey       crypto.PublicKey
+	TunnelIP        net.IP // nil if not assigned
+	AllowedNetworks []*net.IPNet
+	NotBefore       time.Time
+	NotAfter        time.Time
+
+	body      []byte // Signed encoding, set once the certificate is signed or parsed
+	signature []byte
+}
+
+// certBody is the signed encoding of a certificate
+type certBody struct {
+	Serial          uint64   `json:"serial"`
+	Name            string   `json:"name"`
+	PublicKey       string   `json:"public_key"`
+	TunnelIP        string   `json:"tunnel_ip,omitempty"`
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+	NotBefore       int64    `json:"not_before"`
+	NotAfter        int64    `json:"not_after"`
+}
+
+// Certificate verification errors
+var (
+	ErrCertSignature = errors.New("certificate is not signed by a trusted CA")
+	ErrCertExpired   = errors.New("certificate has expired")
+	ErrCertNotYet    = errors.New("certificate is not yet valid")
+	ErrCertKey       = errors.New("certificate was issued for another key")
+)
+
+// GenerateCA generates a new Ed25519 CA key pair
+func GenerateCA() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// Sign fills in a random serial number if none is set and signs the
+// certificate with a CA key
+func (c *Certificate) Sign(ca ed25519.PrivateKey) error {
+	if c.Serial == 0 {
+		var buf [8]byte
+		if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+			return err
+		}
+		c.Serial = binary.BigEndian.Uint64(buf[:])
+	}
+
+	body := certBody{
+		Serial:    c.Serial,
+		Name:      c.Name,
+		PublicKey: c.PublicKey.String(),
+		NotBefore: c.NotBefore.Unix(),
+		NotAfter:  c.NotAfter.Unix(),
+	}
+	if c.TunnelIP != nil {
+		body.TunnelIP = c.TunnelIP.String()
+	}
+	for _, network := range c.AllowedNetworks {
+		body.AllowedNetworks = append(body.AllowedNetworks, network.String())
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	c.body = data
+	c.signature = ed25519.Sign(ca, signedMessage(data))
+	return nil
+}
+
+// Verify checks that the certificate is signed by one of the trusted CA
+// keys, is valid at the given time and was issued for the given key
+func (c *Certificate) Verify(cas []ed25519.PublicKey, key crypto.PublicKey, now time.Time) error {
+	trusted := false
+	for _, ca := range cas {
+		if ed25519.Verify(ca, signedMessage(c.body), c.signature) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrCertSignature
+	}
+
+	if now.Before(c.NotBefore) {
+		return ErrCertNotYet
+	}
+	if !now.Before(c.NotAfter) {
+		return ErrCertExpired
+	}
+	if c.PublicKey != key {
+		return ErrCertKey
+	}
+	return nil
+}
+
+// Marshal encodes a signed certificate for the handshake: the length of the
+// body, the body and the signature
+func (c *Certificate) Marshal() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(c.body)))
+	buf = append(buf, c.body...)
+	return append(buf, c.signature...)
+}
+
+// ParseCertificate decodes a certificate produced by Marshal. The signature
+// is not checked; use Verify.
+func ParseCertificate(data []byte) (*Certificate, error) {
+	if len(data) < 2 {
+		return nil, errors.New("certificate too short")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) != 2+n+ed25519.SignatureSize {
+		return nil, errors.New("invalid certificate length")
+	}
+
+	var body certBody
+	if err := json.Unmarshal(data[2:2+n], &body); err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	c := &Certificate{
+		Serial:    body.Serial,
+		Name:      body.Name,
+		NotBefore: time.Unix(body.NotBefore, 0),
+		NotAfter:  time.Unix(body.NotAfter, 0),
+		body:      append([]byte(nil), data[2:2+n]...),
+		signature: append([]byte(nil), data[2+n:]...),
+	}
+
+	if c.Name == "" {
+		return nil, errors.New("certificate has no name")
+	}
+
+	key, err := crypto.ParsePublicKey(body.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("certificate public key: %w", err)
+	}
+	c.PublicKey = key
+
+	if body.TunnelIP != "" {
+		c.TunnelIP = net.ParseIP(body.TunnelIP)
+		if c.TunnelIP == nil {
+			return nil, fmt.Errorf("certificate has invalid tunnel IP: %s", body.TunnelIP)
+		}
+	}
+
+	for _, s := range body.AllowedNetworks {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("certificate allowed network: %w", err)
+		}
+		c.AllowedNetworks = append(c.AllowedNetworks, network)
+	}
+
+	return c, nil
+}
+
+// User returns the user a certificate authenticates
+func (c *Certificate) User() *User {
+	return &User{
+		Name:          c.Name,
+		PublicKeys:    []crypto.PublicKey{c.PublicKey},
+		TunnelIP:      c.TunnelIP,
+		AllowedRoutes: c.AllowedNetworks,
+		CertSerial:    c.Serial,
+	}
+}
+
+func signedMessage(body []byte) []byte {
+	msg := make([]byte, 0, len(certSignatureContext)+len(body))
+	msg = append(msg, certSignatureContext...)
+	return append(msg, body...)
+}
+
+// WriteCertificate writes a signed certificate to a PEM file
+func WriteCertificate(path string, c *Certificate) error {
+	return writePEM(path, certPEMType, c.Marshal(), 0644)
+}
+
+// LoadCertificate reads a certificate from a PEM file
+func LoadCertificate(path string) (*Certificate, error) {
+	data, err := readPEM(path, certPEMType)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCertificate(data)
+}
+
+// WriteCAPrivateKey writes a CA private key to a PEM file readable only by its owner
+func WriteCAPrivateKey(path string, key ed25519.PrivateKey) error {
+	return writePEM(path, caPrivateKeyPEMType, key.Seed(), 0600)
+}
+
+// LoadCAPrivateKey reads a CA private key from a PEM file
+func LoadCAPrivateKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := readPEM(path, caPrivateKeyPEMType)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid CA private key size", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// WriteCAPublicKey writes a CA public key to a PEM file
+func WriteCAPublicKey(path string, key ed25519.PublicKey) error {
+	return writePEM(path, caPublicKeyPEMType, key, 0644)
+}
+
+// LoadCAPublicKeys reads every CA public key from a PEM file. Several CAs
+// can be trusted at once, for example while rolling over to a new CA key.
+func LoadCAPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != caPublicKeyPEMType {
+			continue
+		}
+		if len(block.Bytes) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid CA public key size", path)
+		}
+		keys = append(keys, ed25519.PublicKey(block.Bytes))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no %s found", path, caPublicKeyPEMType)
+	}
+	return keys, nil
+}
+
+func writePEM(path, blockType string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), perm)
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no %s found", path, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+// signedCertificate returns a certificate for key, valid for a day from
+// notBefore, signed by a new CA, and that CA's public key
+func signedCertificate(t *testing.T, key crypto.PublicKey, notBefore time.Time) (*Certificate, ed25519.PublicKey) {
+	t.Helper()
+
+	caPub, caKey, err := GenerateCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, err := net.ParseCIDR("10.1.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &Certificate{
+		Name:            "alice",
+		PublicKey:       key,
+		TunnelIP:        net.ParseIP("10.0.0.9"),
+		AllowedNetworks: []*net.IPNet{network},
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(24 * time.Hour),
+	}
+	if err := cert.Sign(caKey); err != nil {
+		t.Fatal(err)
+	}
+	return cert, caPub
+}
+
+// encodeCertificate encodes a body and a signature the way Marshal does
+func encodeCertificate(body string, signature []byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(body)))
+	buf = append(buf, body...)
+	return append(buf, signature...)
+}
+
+func TestCertificateRoundTrip(t *testing.T) {
+	key := crypto.PublicKey{1}
+	notBefore := time.Unix(1700000000, 0)
+	cert, ca := signedCertificate(t, key, notBefore)
+	if cert.Serial == 0 {
+		t.Fatal("no serial filled in")
+	}
+
+	parsed, err := ParseCertificate(cert.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Serial != cert.Serial || parsed.Name != "alice" || parsed.PublicKey != key {
+		t.Fatalf("got %+v, want %+v", parsed, cert)
+	}
+	if !parsed.TunnelIP.Equal(cert.TunnelIP) {
+		t.Fatalf("tunnel IP: got %v, want %v", parsed.TunnelIP, cert.TunnelIP)
+	}
+	if len(parsed.AllowedNetworks) != 1 || parsed.AllowedNetworks[0].String() != "10.1.0.0/16" {
+		t.Fatalf("allowed networks: got %v", parsed.AllowedNetworks)
+	}
+	if !parsed.NotBefore.Equal(cert.NotBefore) || !parsed.NotAfter.Equal(cert.NotAfter) {
+		t.Fatalf("validity: got %v-%v, want %v-%v", parsed.NotBefore, parsed.NotAfter, cert.NotBefore, cert.NotAfter)
+	}
+	if err := parsed.Verify([]ed25519.PublicKey{ca}, key, notBefore.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateVerify(t *testing.T) {
+	key := crypto.PublicKey{1}
+	notBefore := time.Unix(1700000000, 0)
+	cert, ca := signedCertificate(t, key, notBefore)
+	otherCert, otherCA := signedCertificate(t, key, notBefore)
+	valid := notBefore.Add(time.Hour)
+
+	// The same certificate signed by another CA key
+	forged := *cert
+	forged.signature = otherCert.signature
+
+	tamperedBody, err := ParseCertificate(bytes.Replace(cert.Marshal(), []byte(`"alice"`), []byte(`"admin"`), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedSignature := *cert
+	tamperedSignature.signature = append([]byte(nil), cert.signature...)
+	tamperedSignature.signature[0] ^= 1
+
+	tests := []struct {
+		name string
+		cert *Certificate
+		cas  []ed25519.PublicKey
+		key  crypto.PublicKey
+		now  time.Time
+		want error
+	}{
+		{"valid", cert, []ed25519.PublicKey{ca}, key, valid, nil},
+		{"one of several CAs", cert, []ed25519.PublicKey{otherCA, ca}, key, valid, nil},
+		{"tampered body", tamperedBody, []ed25519.PublicKey{ca}, key, valid, ErrCertSignature},
+		{"tampered signature", &tamperedSignature, []ed25519.PublicKey{ca}, key, valid, ErrCertSignature},
+		{"wrong signing key", &forged, []ed25519.PublicKey{ca}, key, valid, ErrCertSignature},
+		{"wrong CA", cert, []ed25519.PublicKey{otherCA}, key, valid, ErrCertSignature},
+		{"no CAs", cert, nil, key, valid, ErrCertSignature},
+		{"at NotBefore", cert, []ed25519.PublicKey{ca}, key, notBefore, nil},
+		{"before NotBefore", cert, []ed25519.PublicKey{ca}, key, notBefore.Add(-time.Second), ErrCertNotYet},
+		{"just before NotAfter", cert, []ed25519.PublicKey{ca}, key, cert.NotAfter.Add(-time.Second), nil},
+		{"at NotAfter", cert, []ed25519.PublicKey{ca}, key, cert.NotAfter, ErrCertExpired},
+		{"after NotAfter", cert, []ed25519.PublicKey{ca}, key, cert.NotAfter.Add(time.Hour), ErrCertExpired},
+		{"other client key", cert, []ed25519.PublicKey{ca}, crypto.PublicKey{2}, valid, ErrCertKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cert.Verify(tt.cas, tt.key, tt.now); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCertificateMalformed(t *testing.T) {
+	cert, _ := signedCertificate(t, crypto.PublicKey{1}, time.Unix(1700000000, 0))
+	data := cert.Marshal()
+	signature := make([]byte, ed25519.SignatureSize)
+	key := crypto.PublicKey{1}.String()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"length only", data[:1]},
+		{"truncated signature", data[:len(data)-1]},
+		{"trailing data", append(append([]byte(nil), data...), 0)},
+		{"body length too long", append([]byte{0xff, 0xff}, data[2:]...)},
+		{"invalid JSON", encodeCertificate(`{"serial":`, signature)},
+		{"no name", encodeCertificate(`{"serial":1,"public_key":"`+key+`","not_before":0,"not_after":1}`, signature)},
+		{"invalid public key", encodeCertificate(`{"serial":1,"name":"alice","public_key":"xyz","not_before":0,"not_after":1}`, signature)},
+		{"invalid tunnel IP", encodeCertificate(`{"serial":1,"name":"alice","public_key":"`+key+`","tunnel_ip":"10.0.0","not_before":0,"not_after":1}`, signature)},
+		{"invalid network", encodeCertificate(`{"serial":1,"name":"alice","public_key":"`+key+`","allowed_networks":["10.0.0.0/33"],"not_before":0,"not_after":1}`, signature)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseCertificate(tt.data); err == nil {
+				t.Fatal("malformed certificate parsed")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+// RevocationList holds revoked certificate serials, client public keys and
+// user names
+type RevocationList struct {
+	serials map[uint64]bool
+	keys    map[crypto.PublicKey]bool
+	users   map[string]bool
+}
+
+// LoadRevocationList reads a revocation list, one entry per line:
+//
+//	serial 16225757179771542290
+//	key mwTXkYzHpPVucmos04d+PJfQdWf0J3gWeAtuc9zBejw=
+//	user alice
+//
+// A user entry locks the user out whatever it authenticates with: its
+// password from any key, its keys or a certificate issued in its name.
+// Blank lines and lines starting with '#' are ignored.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &RevocationList{
+		serials: make(map[uint64]bool),
+		keys:    make(map[crypto.PublicKey]bool),
+		users:   make(map[string]bool),
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"serial <number>\", \"key <public key>\" or \"user <name>\"", path, lineNum)
+		}
+
+		switch fields[0] {
+		case "serial":
+			serial, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid serial: %w", path, lineNum, err)
+			}
+			list.serials[serial] = true
+		case "key":
+			key, err := crypto.ParsePublicKey(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+			}
+			list.keys[key] = true
+		case "user":
+			list.users[fields[1]] = true
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown entry type %q", path, lineNum, fields[0])
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// Revoked reports whether a client key, the user a session belongs to, or
+// the certificate the user authenticated with, has been revoked. A nil list
+// revokes nothing.
+func (l *RevocationList) Revoked(key crypto.PublicKey, user *User) bool {
+	if l == nil {
+		return false
+	}
+	if l.keys[key] {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	return l.users[user.Name] || (user.CertSerial != 0 && l.serials[user.CertSerial])
+}
+
+// Len returns the number of revoked serials, keys and users
+func (l *RevocationList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.serials) + len(l.keys) + len(l.users)
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+func writeRevocationList(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "revoked.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRevocationList(t *testing.T) {
+	revokedKey := crypto.PublicKey{1}
+	path := writeRevocationList(t, `# comment
+
+serial 42
+key `+revokedKey.String()+`
+user bob
+`)
+	list, err := LoadRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 3 {
+		t.Fatalf("got %d entries, want 3", list.Len())
+	}
+
+	otherKey := crypto.PublicKey{2}
+	tests := []struct {
+		name string
+		key  crypto.PublicKey
+		user *User
+		want bool
+	}{
+		{"revoked key", revokedKey, nil, true},
+		{"revoked key of a user", revokedKey, &User{Name: "alice"}, true},
+		{"allow-listed key", otherKey, nil, false},
+		{"revoked user with any key", otherKey, &User{Name: "bob"}, true},
+		{"revoked user with a certificate", otherKey, &User{Name: "bob", CertSerial: 7}, true},
+		{"revoked certificate", otherKey, &User{Name: "alice", CertSerial: 42}, true},
+		{"other certificate", otherKey, &User{Name: "alice", CertSerial: 7}, false},
+		{"database user", otherKey, &User{Name: "alice"}, false},
+	}
+	for _, tt := range tests {
+		if got := list.Revoked(tt.key, tt.user); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var none *RevocationList
+	if none.Revoked(revokedKey, &User{Name: "bob"}) || none.Len() != 0 {
+		t.Error("nil list revokes")
+	}
+}
+
+func TestRevocationListInvalid(t *testing.T) {
+	for _, content := range []string{
+		"serial abc\n",
+		"serial\n",
+		"key not-a-key\n",
+		"user\n",
+		"user two names\n",
+		"group admins\n",
+	} {
+		if _, err := LoadRevocationList(writeRevocationList(t, content)); err == nil {
+			t.Errorf("%q accepted", content)
+		}
+	}
+}
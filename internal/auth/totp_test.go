@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 Appendix B lists 8-digit codes; 6-digit codes are their
+	// last six digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		want := tt.code[len(tt.code)-TOTPDigits:]
+		now := time.Unix(tt.unix, 0)
+
+		step := uint64(tt.unix) / uint64(TOTPPeriod/time.Second)
+		if got := totpCode(rfc6238Secret, step); got != want {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, want)
+		}
+		if got, ok := VerifyTOTP(rfc6238Secret, want, now); !ok || got != step {
+			t.Errorf("T=%d: VerifyTOTP returned step %d, %v", tt.unix, got, ok)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := uint64(now.Unix()) / uint64(TOTPPeriod/time.Second)
+
+	for _, offset := range []int64{-1, 0, 1} {
+		code := totpCode(rfc6238Secret, uint64(int64(step)+offset))
+		got, ok := VerifyTOTP(rfc6238Secret, code, now)
+		if !ok || got != uint64(int64(step)+offset) {
+			t.Errorf("code %d steps off: got step %d, %v", offset, got, ok)
+		}
+	}
+	for _, offset := range []int64{-2, 2} {
+		code := totpCode(rfc6238Secret, uint64(int64(step)+offset))
+		if _, ok := VerifyTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %d steps off accepted", offset)
+		}
+	}
+}
+
+func TestVerifyTOTPMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "abcdef"} {
+		if _, ok := VerifyTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
+
+func TestParseTOTPSecret(t *testing.T) {
+	encoded := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // rfc6238Secret
+
+	for _, s := range []string{encoded, strings.ToLower(encoded), "GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ", encoded + "===="} {
+		secret, err := ParseTOTPSecret(s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		if string(secret) != string(rfc6238Secret) {
+			t.Fatalf("%q: got %q", s, secret)
+		}
+	}
+	for _, s := range []string{"", "not base32!", "1"} {
+		if _, err := ParseTOTPSecret(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+// User is an account in the user database
+type User struct {
+	Name string
+	// PasswordHash is a PHC-encoded Argon2id hash; empty if the user
+	// cannot log in with a password
+	PasswordHash string
+	// PublicKeys are the client keys the user connects with. A user with
+	// keys must use one of them, with or without a password.
+	PublicKeys []crypto.PublicKey
+	// TunnelIP is the address assigned to the user inside the tunnel, or nil
+	TunnelIP net.IP
+	// AllowedRoutes are the networks the user may reach through the tunnel;
+	// the server drops packets to other destinations and pushes them to
+	// the client as its routes. Empty means no restriction.
+	AllowedRoutes []*net.IPNet
+	// Subnets are networks behind the user's client, such as a branch
+	// office LAN; the server routes traffic for them to its session
+	Subnets []*net.IPNet
+	// TOTPSecret flags the user for a second factor: every new session
+	// must present a current one-time code generated from it
+	TOTPSecret []byte
+	Disabled   bool
+	// CertSerial is the serial of the certificate the user authenticated
+	// with, or 0 for users from the database
+	CertSerial uint64
+}
+
+// HasKey reports whether key is one of the user's public keys
+func (u *User) HasKey(key crypto.PublicKey) bool {
+	for _, k := range u.PublicKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresOTP reports whether the user must present a one-time code
+func (u *User) RequiresOTP() bool {
+	return len(u.TOTPSecret) > 0
+}
+
+// userFile is the on-disk format of the user database
+type userFile struct {
+	Users []userEntry `json:"users"`
+}
+
+type userEntry struct {
+	Name          string   `json:"name"`
+	PasswordHash  string   `json:"password_hash,omitempty"`
+	PublicKeys    []string `json:"public_keys,omitempty"`
+	TunnelIP      string   `json:"tunnel_ip,omitempty"`
+	AllowedRoutes []string `json:"allowed_routes,omitempty"`
+	Subnets       []string `json:"subnets,omitempty"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	Disabled      bool     `json:"disabled,omitempty"`
+}
+
+// UserDB maps user names and client keys to users
+type UserDB struct {
+	byName map[string]*User
+	byKey  map[crypto.PublicKey]*User
+	byIP   map[string]*User
+}
+
+// NewUserDB creates an empty user database
+func NewUserDB() *UserDB {
+	return &UserDB{
+		byName: make(map[string]*User),
+		byKey:  make(map[crypto.PublicKey]*User),
+		byIP:   make(map[string]*User),
+	}
+}
+
+// LoadUsers reads a JSON user database:
+//
+//	{"users": [{"name": "alice", "password_hash": "$argon2id$...",
+//	  "public_keys": ["..."], "tunnel_ip": "10.0.0.2",
+//	  "allowed_routes": ["10.0.0.0/24"], "subnets": ["192.168.10.0/24"],
+//	  "totp_secret": "JBSWY3DP...", "disabled": false}]}
+func LoadUsers(path string) (*UserDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file userFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	db := NewUserDB()
+	for i, entry := range file.Users {
+		user, err := entry.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %d: %w", path, i+1, err)
+		}
+		if err := db.Add(user); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return db, nil
+}
+
+func (e *userEntry) parse() (*User, error) {
+	if e.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+
+	user := &User{
+		Name:         e.Name,
+		PasswordHash: e.PasswordHash,
+		Disabled:     e.Disabled,
+	}
+
+	if e.PasswordHash != "" {
+		if err := crypto.ValidatePasswordHash(e.PasswordHash); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name, err)
+		}
+	}
+
+	for _, s := range e.PublicKeys {
+		key, err := crypto.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: public key: %w", e.Name, err)
+		}
+		user.PublicKeys = append(user.PublicKeys, key)
+	}
+
+	if e.TunnelIP != "" {
+		user.TunnelIP = net.ParseIP(e.TunnelIP)
+		if user.TunnelIP == nil {
+			return nil, fmt.Errorf("%s: invalid tunnel IP: %s", e.Name, e.TunnelIP)
+		}
+	}
+
+	for _, s := range e.AllowedRoutes {
+		_, route, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: allowed route: %w", e.Name, err)
+		}
+		user.AllowedRoutes = append(user.AllowedRoutes, route)
+	}
+
+	for _, s := range e.Subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: subnet: %w", e.Name, err)
+		}
+		user.Subnets = append(user.Subnets, subnet)
+	}
+
+	if e.TOTPSecret != "" {
+		secret, err := ParseTOTPSecret(e.TOTPSecret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		user.TOTPSecret = secret
+	}
+
+	if user.PasswordHash == "" && len(user.PublicKeys) == 0 && !user.Disabled {
+		return nil, fmt.Errorf("%s: needs a password hash or a public key", e.Name)
+	}
+
+	return user, nil
+}
+
+// Add adds a user. User names, public keys and tunnel IPs must be unique.
+func (db *UserDB) Add(user *User) error {
+	if _, dup := db.byName[user.Name]; dup {
+		return fmt.Errorf("duplicate user %s", user.Name)
+	}
+	if user.TunnelIP != nil {
+		if other, dup := db.byIP[user.TunnelIP.String()]; dup {
+			return fmt.Errorf("tunnel IP %s is assigned to both %s and %s", user.TunnelIP, other.Name, user.Name)
+		}
+	}
+	for _, key := range user.PublicKeys {
+		if other, dup := db.byKey[key]; dup {
+			return fmt.Errorf("public key %s is used by both %s and %s", key, other.Name, user.Name)
+		}
+	}
+
+	db.byName[user.Name] = user
+	if user.TunnelIP != nil {
+		db.byIP[user.TunnelIP.String()] = user
+	}
+	for _, key := range user.PublicKeys {
+		db.byKey[key] = user
+	}
+	return nil
+}
+
+// Lookup returns the user with the given name
+func (db *UserDB) Lookup(name string) (*User, bool) {
+	user, ok := db.byName[name]
+	return user, ok
+}
+
+// LookupKey returns the user a client key belongs to
+func (db *UserDB) LookupKey(key crypto.PublicKey) (*User, bool) {
+	user, ok := db.byKey[key]
+	return user, ok
+}
+
+// LookupIP returns the user a tunnel IP is assigned to
+func (db *UserDB) LookupIP(ip net.IP) (*User, bool) {
+	user, ok := db.byIP[ip.String()]
+	return user, ok
+}
+
+// TunnelIPs returns the tunnel IPs assigned to users
+func (db *UserDB) TunnelIPs() []net.IP {
+	ips := make([]net.IP, 0, len(db.byIP))
+	for _, user := range db.byIP {
+		ips = append(ips, user.TunnelIP)
+	}
+	return ips
+}
+
+// Len returns the number of users
+func (db *UserDB) Len() int {
+	return len(db.byName)
+}
@@ -4,180 +4,881 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	mathrand "math/rand/v2"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/nees/omail/internal/auth"
 	"github.com/nees/omail/internal/crypto"
 	"github.com/nees/omail/internal/protocol"
 	"github.com/nees/omail/internal/routing"
 	"github.com/nees/omail/internal/tun"
 )
 
+const (
+	// handshakeTimeout is how long to wait for a handshake response
+	handshakeTimeout = 5 * time.Second
+	// handshakeAttempts is how many handshake inits are sent before giving up
+	handshakeAttempts = 3
+	// configTimeout is how long to wait for the tunnel configuration before
+	// asking for it again
+	configTimeout = 2 * time.Second
+	// keepAliveInterval is how often a keep-alive is sent
+	keepAliveInterval = 10 * time.Second
+	// deadPeerTimeout is how long the client waits without authenticated
+	// traffic from a server that answers keep-alives before reconnecting
+	deadPeerTimeout = 3 * keepAliveInterval
+	// reconnectMinDelay and reconnectMaxDelay bound the backoff between
+	// reconnect attempts
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
 // Client represents a VPN client
 type Client struct {
-	serverAddr  string
-	crypto      *crypto.Crypto
+	serverAddrs []string
+	privateKey  crypto.PrivateKey
+	serverKey   crypto.PublicKey
+	psk         crypto.PresharedKey
+	kexMode     crypto.KEXMode
+	suites      []crypto.CipherSuite
+	certificate *auth.Certificate
+	username    string
+	password    string
+	otpSource   func() (string, error)
+	otp         string // One-time code for the handshake in progress
+	keys        crypto.Keyring
+	cookies     *crypto.CookieGenerator
 	tun         *tun.Interface
-	udpConn     *net.UDPConn
-	sessionID   uint32
-	serverUDP   *net.UDPAddr
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
 	routing     *routing.Manager
 	splitTunnel []*net.IPNet
+	killSwitch  bool
+	tunIP       net.IP     // Fallback when the server assigns no address
+	tunMask     net.IPMask // Fallback when the server pushes no netmask
+	mtu         int        // Set when configured locally, overriding the server's
+
+	// endpoints are the server's addresses as last resolved
+	endpoints []*net.UDPAddr
+
+	// The connection to the server is replaced on every reconnect
+	connMu    sync.Mutex
+	udpConn   *net.UDPConn
+	serverUDP *net.UDPAddr
+	sessionID atomic.Uint32
+
+	// Goroutines of the current connection, stopped for a reconnect
+	sessionCancel context.CancelFunc
+	sessionWG     sync.WaitGroup
+	connected     atomic.Bool  // Whether traffic may be sent
+	lastReceived  atomic.Int64 // Unix nanoseconds of the last authenticated packet
+	reconnectCh   chan struct{}
+
+	handshakeMu  sync.Mutex
+	pending      *crypto.Handshake
+	pendingEpoch uint8
+	pendingSent  time.Time
+	keysSession  uint32                // Session ID the installed keys were negotiated for
+	kex          string                // Key exchange of the last completed handshake
+	capabilities protocol.Capabilities // Features both sides support
+	rekeyCh      chan struct{}
+
+	replaysDropped atomic.Uint64
+
+	// done is closed when the server ends the session; doneErr says why
+	done     chan struct{}
+	doneOnce sync.Once
+	doneErr  error
 }
 
 // Config holds client configuration
 type Config struct {
-	ServerAddr  string
-	Password    string
-	TUNName     string
+	// ServerAddrs are the endpoints of the server as host:port. The client
+	// connects to the one that answers a ping fastest and fails over to
+	// the others; a host name stands for all of its addresses. All
+	// endpoints must share the server key.
+	ServerAddrs []string
+	PrivateKey  crypto.PrivateKey
+	ServerKey   crypto.PublicKey
+	// PresharedKey is mixed into every handshake; it must match the one the
+	// server holds for this client. Zero if not configured.
+	PresharedKey crypto.PresharedKey
+	// KEXMode selects whether handshakes offer ML-KEM-768 alongside X25519.
+	// Defaults to crypto.KEXHybrid, which still works with classic servers.
+	KEXMode crypto.KEXMode
+	// CipherSuites lists the transport cipher suites offered to the server,
+	// in order of preference. Defaults to crypto.DefaultSuites().
+	CipherSuites []crypto.CipherSuite
+	// Certificate is a CA-signed certificate for PrivateKey, for servers
+	// that authenticate clients by certificate
+	Certificate *auth.Certificate
+	// Username and Password authenticate to servers that accept passwords
+	Username string
+	Password string
+	// OTP supplies a one-time code when the server requires a second
+	// factor for the user. It is called at most once, by Connect.
+	OTP     func() (string, error)
+	TUNName string
+	// TUNIP and TUNNetmask address the TUN interface when the server does
+	// not assign an address. MTU, if set, overrides the server's.
 	TUNIP       string
 	TUNNetmask  string
 	MTU         int
 	SplitTunnel []*net.IPNet // If empty, full tunnel
+	// KillSwitch blocks all traffic outside the tunnel except to the
+	// server, from the first connection until Disconnect, reconnects
+	// included
+	KillSwitch bool
 }
 
 // NewClient creates a new VPN client
 func NewClient(config Config) (*Client, error) {
-	crypto, err := crypto.NewCrypto(config.Password)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create crypto: %w", err)
+	if config.PrivateKey == (crypto.PrivateKey{}) {
+		return nil, fmt.Errorf("private key is required")
 	}
-
-	tunInterface, err := tun.New(config.TUNName, config.MTU)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create TUN interface: %w", err)
+	if len(config.ServerAddrs) == 0 {
+		return nil, fmt.Errorf("server address is required")
+	}
+	if config.ServerKey == (crypto.PublicKey{}) {
+		return nil, fmt.Errorf("server public key is required")
 	}
 
-	// Parse TUN IP and netmask
-	tunIP := net.ParseIP(config.TUNIP)
-	if tunIP == nil {
-		return nil, fmt.Errorf("invalid TUN IP: %s", config.TUNIP)
+	if config.Certificate != nil && config.Certificate.PublicKey != config.PrivateKey.PublicKey() {
+		return nil, fmt.Errorf("certificate was issued for another key")
 	}
 
-	var mask net.IPMask
-	if config.TUNNetmask != "" {
-		mask = net.IPMask(net.ParseIP(config.TUNNetmask).To4())
-	} else {
-		mask = net.CIDRMask(24, 32) // Default /24
+	suites := config.CipherSuites
+	if len(suites) == 0 {
+		suites = crypto.DefaultSuites()
 	}
 
-	// Set IP and bring interface up
-	if err := tunInterface.SetIP(tunIP, mask); err != nil {
-		tunInterface.Close()
-		return nil, fmt.Errorf("failed to set TUN IP: %w", err)
+	// Parse the fallback TUN IP and netmask
+	var tunIP net.IP
+	if config.TUNIP != "" {
+		tunIP = net.ParseIP(config.TUNIP)
+		if tunIP == nil {
+			return nil, fmt.Errorf("invalid TUN IP: %s", config.TUNIP)
+		}
 	}
 
-	if err := tunInterface.Up(); err != nil {
-		tunInterface.Close()
-		return nil, fmt.Errorf("failed to bring TUN up: %w", err)
+	var mask net.IPMask
+	if config.TUNNetmask != "" {
+		mask = net.IPMask(net.ParseIP(config.TUNNetmask).To4())
 	}
 
-	// Resolve server address
-	serverUDP, err := net.ResolveUDPAddr("udp", config.ServerAddr)
-	if err != nil {
-		tunInterface.Close()
-		return nil, fmt.Errorf("failed to resolve server address: %w", err)
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = tun.DefaultMTU
 	}
 
-	// Create UDP connection
-	conn, err := net.DialUDP("udp", nil, serverUDP)
+	// The interface is addressed and brought up by Connect, once the
+	// server has pushed the tunnel configuration
+	tunInterface, err := tun.New(config.TUNName, mtu)
 	if err != nil {
-		tunInterface.Close()
-		return nil, fmt.Errorf("failed to dial server: %w", err)
+		return nil, fmt.Errorf("failed to create TUN interface: %w", err)
 	}
 
-	// Generate session ID
-	sessionID := generateSessionID()
-
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
-		serverAddr:  config.ServerAddr,
-		crypto:      crypto,
+		serverAddrs: config.ServerAddrs,
+		privateKey:  config.PrivateKey,
+		serverKey:   config.ServerKey,
+		psk:         config.PresharedKey,
+		kexMode:     config.KEXMode,
+		suites:      suites,
+		cookies:     crypto.NewCookieGenerator(config.ServerKey),
+		certificate: config.Certificate,
+		username:    config.Username,
+		password:    config.Password,
+		otpSource:   config.OTP,
 		tun:         tunInterface,
-		udpConn:     conn,
-		sessionID:   sessionID,
-		serverUDP:   serverUDP,
 		ctx:         ctx,
 		cancel:      cancel,
 		routing:     routing.NewManager(config.TUNName),
 		splitTunnel: config.SplitTunnel,
+		killSwitch:  config.KillSwitch,
+		tunIP:       tunIP,
+		tunMask:     mask,
+		mtu:         config.MTU,
+		rekeyCh:     make(chan struct{}, 1),
+		reconnectCh: make(chan struct{}, 1),
+		done:        make(chan struct{}),
 	}
 
 	return client, nil
 }
 
+// dial opens a new connection to a server endpoint with a new session ID,
+// in place of the previous one
+func (c *Client) dial(serverUDP *net.UDPAddr) error {
+	conn, err := net.DialUDP("udp", nil, serverUDP)
+	if err != nil {
+		return fmt.Errorf("failed to dial server: %w", err)
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	// Disconnect may have closed the previous connection meanwhile
+	if c.ctx.Err() != nil {
+		conn.Close()
+		return c.ctx.Err()
+	}
+	if c.udpConn != nil {
+		c.udpConn.Close()
+	}
+	c.udpConn = conn
+	c.serverUDP = serverUDP
+	c.sessionID.Store(generateSessionID())
+	return nil
+}
+
+// conn returns the current connection to the server
+func (c *Client) conn() *net.UDPConn {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.udpConn
+}
+
 // Connect connects to the VPN server
 func (c *Client) Connect() error {
-	log.Printf("Connecting to VPN server at %s", c.serverAddr)
+	log.Printf("Connecting to VPN server at %s", strings.Join(c.serverAddrs, ", "))
+	log.Printf("Client public key: %s", c.privateKey.PublicKey())
 	log.Printf("TUN interface: %s", c.tun.Name())
 
-	// Send initial keep-alive to establish session
-	if err := c.sendKeepAlive(); err != nil {
+	if err := c.connectAny(); err != nil {
+		c.removeKillSwitch()
+		return err
+	}
+
+	// Start reading from TUN; the device outlives reconnects
+	c.wg.Add(1)
+	go c.readFromTUN()
+
+	c.startSession()
+
+	// One-time codes are single-use: a reconnect resumes the session with
+	// its keys or fails, rather than reusing -otp or prompting from the
+	// background
+	c.otpSource = nil
+
+	// Reconnect whenever the server stops answering
+	c.wg.Add(1)
+	go c.supervise()
+
+	log.Println("Connected to VPN server")
+	if c.killSwitch {
+		log.Println("Kill switch enabled: traffic outside the tunnel is blocked until disconnect")
+	}
+
+	return nil
+}
+
+// establish performs the key exchange on the current connection, then
+// addresses the tunnel and sets up routing as the server says
+func (c *Client) establish() error {
+	// Perform the key exchange before any traffic is sent
+	if err := c.handshake(); err != nil {
 		return fmt.Errorf("failed to establish session: %w", err)
 	}
+	log.Printf("Session established (cipher: %s, kex: %s, capabilities: %s)", c.keys.Current().Suite().Name(), c.kex, c.capabilities)
+
+	config, err := c.receiveConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+	if err := c.configureTUN(config); err != nil {
+		return err
+	}
 
 	// Setup routing
-	if err := c.setupRouting(); err != nil {
+	if err := c.setupRouting(config); err != nil {
 		log.Printf("Warning: failed to setup routing: %v", err)
 		// Continue anyway
 	}
+	return nil
+}
 
-	// Start reading from TUN
-	c.wg.Add(1)
-	go c.readFromTUN()
+// startSession starts the goroutines that carry the traffic of the current
+// connection
+func (c *Client) startSession() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	// Disconnect may have stopped the client meanwhile
+	if c.ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.sessionCancel = cancel
+	c.lastReceived.Store(time.Now().UnixNano())
+	c.connected.Store(true)
 
 	// Start reading from UDP
-	c.wg.Add(1)
-	go c.readFromUDP()
+	c.sessionWG.Add(1)
+	go c.readFromUDP(ctx, c.udpConn)
 
 	// Start keep-alive goroutine
-	c.wg.Add(1)
-	go c.keepAlive()
+	c.sessionWG.Add(1)
+	go c.keepAlive(ctx)
+}
 
-	log.Println("Connected to VPN server")
+// stopSession stops the goroutines of the current connection and closes it
+func (c *Client) stopSession() {
+	c.connected.Store(false)
 
-	return nil
+	c.connMu.Lock()
+	if c.sessionCancel != nil {
+		c.sessionCancel()
+	}
+	if c.udpConn != nil {
+		c.udpConn.Close()
+	}
+	c.connMu.Unlock()
+
+	c.sessionWG.Wait()
+}
+
+// triggerReconnect asks the supervisor to replace the connection
+func (c *Client) triggerReconnect() {
+	select {
+	case c.reconnectCh <- struct{}{}:
+	default:
+	}
+}
+
+// supervise reconnects when asked to until the client disconnects
+func (c *Client) supervise() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.reconnectCh:
+			c.reconnect()
+		}
+	}
+}
+
+// reconnect replaces a dead connection: it probes the server's endpoints
+// again, resolving their names anew, and repeats the handshake with the
+// best one, failing over to the others, waiting a jittered, exponentially growing delay
+// between attempts, until it succeeds, the client disconnects or the server
+// refuses the client for good. The TUN device stays up throughout and gets
+// the configuration the server pushes with the new session.
+func (c *Client) reconnect() {
+	c.stopSession()
+
+	// Without the tunnel's routes the handshake reaches the server directly
+	if err := c.routing.Cleanup(); err != nil {
+		log.Printf("Warning: failed to cleanup routing: %v", err)
+	}
+
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		// Waiting between half and all of the delay keeps clients that lost
+		// the server together from all coming back at the same moment
+		wait := delay/2 + mathrand.N(delay/2)
+		log.Printf("Reconnecting in %s (attempt %d)", wait.Round(time.Millisecond), attempt)
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		err := c.connectAny()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			c.startSession()
+			log.Println("Reconnected to VPN server")
+			return
+		}
+		if isPermanent(err) {
+			if errors.Is(err, ErrOTPRequired) {
+				err = fmt.Errorf("%w; restart the client with a new one", err)
+			}
+			c.endSession(err)
+			return
+		}
+
+		log.Printf("Reconnect failed: %v", err)
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+}
+
+// isPermanent reports whether a failed reconnect attempt would fail again
+// the same way, so retrying is pointless. A reject is not: it is sent in the
+// clear, so anyone on the path could forge one to cut the client off. Only
+// Connect, before the client has ever reached the server, gives up on one.
+func isPermanent(err error) bool {
+	var sessionErr *protocol.SessionError
+	switch {
+	case errors.Is(err, ErrOTPRequired), errors.Is(err, ErrOTPInvalid):
+		return true
+	case errors.As(err, &sessionErr):
+		return sessionErr.Code == protocol.ErrorCodeRevoked
+	}
+	return false
+}
+
+// Done returns a channel that is closed when the server ends the session
+// for good, or refuses to open a new one after a reconnect
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the server ended the session, once Done is closed
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.doneErr
+	default:
+		return nil
+	}
+}
+
+// endSession records that the server ended the session
+func (c *Client) endSession(err error) {
+	c.doneOnce.Do(func() {
+		c.doneErr = err
+		close(c.done)
+	})
 }
 
-// Disconnect disconnects from the VPN server
+// Disconnect disconnects from the VPN server and lifts the kill switch
 func (c *Client) Disconnect() error {
+	// Let the server drop the session now instead of timing it out
+	if c.connected.Load() {
+		if err := c.sendControl(&protocol.Disconnect{}); err != nil {
+			log.Printf("Failed to send disconnect: %v", err)
+		}
+	}
+
+	err := c.Close()
+	c.removeKillSwitch()
+	return err
+}
+
+// Close shuts the client down once the server has ended the session. Unlike
+// Disconnect it leaves the kill switch in place: the user did not ask for
+// the tunnel to go, so traffic stays blocked until they disconnect.
+func (c *Client) Close() error {
 	c.cancel()
 
+	// Closing the connection also aborts a reconnect in progress
+	c.stopSession()
+
 	// Cleanup routing
 	if err := c.routing.Cleanup(); err != nil {
 		log.Printf("Warning: failed to cleanup routing: %v", err)
 	}
 
-	if c.udpConn != nil {
-		c.udpConn.Close()
-	}
-
 	if c.tun != nil {
 		c.tun.Down()
 		c.tun.Close()
 	}
 
 	c.wg.Wait()
+	c.sessionWG.Wait()
+
+	if dropped := c.replaysDropped.Load(); dropped > 0 {
+		log.Printf("Dropped %d replayed packets during the session", dropped)
+	}
 	return nil
 }
 
-// setupRouting sets up routing tables
-func (c *Client) setupRouting() error {
-	if len(c.splitTunnel) == 0 {
-		// Full tunnel - route all traffic through VPN
+// Errors for handshakes the server answered but refused to open a session for
+var (
+	ErrOTPRequired = errors.New("server requires a one-time code")
+	ErrOTPInvalid  = errors.New("authentication failed: invalid one-time code")
+)
+
+// errNoPendingHandshake is returned for handshake responses that do not
+// answer the handshake in progress, such as duplicates of an answered one
+var errNoPendingHandshake = errors.New("no matching handshake in progress")
+
+// handshake performs the initial key exchange with the server and installs the session keys
+func (c *Client) handshake() error {
+	buf := make([]byte, 65535)
+	conn := c.conn()
+	sessionID := c.sessionID.Load()
+
+	for attempt := 1; attempt <= handshakeAttempts; attempt++ {
+		if err := c.initiateHandshake(0); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(handshakeTimeout)
+		retry := false
+		for !retry {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+
+			reply, err := protocol.Decode(buf[:n])
+			if err != nil || reply.Header.SessionID != sessionID {
+				continue
+			}
+
+			switch reply.Header.Type {
+			case protocol.PacketTypeHandshakeResponse:
+				err := c.completeHandshake(reply)
+				if err == ErrOTPRequired && c.otp == "" && c.otpSource != nil {
+					// Ask for a code and retry at once
+					if c.otp, err = c.otpSource(); err != nil {
+						return fmt.Errorf("failed to read one-time code: %w", err)
+					}
+					retry = true
+					continue
+				}
+				// Codes are single-use; rekeys of this session do not send one
+				c.otp = ""
+				return err
+			case protocol.PacketTypeReject:
+				reject, err := protocol.DecodeReject(reply.Data)
+				if err != nil {
+					continue
+				}
+				return reject
+			case protocol.PacketTypeCookieReply:
+				// The server is under load; retry at once with the cookie
+				if c.cookies.ConsumeReply(reply.Data) == nil {
+					log.Printf("Server is under load, retrying handshake with cookie (attempt %d/%d)", attempt, handshakeAttempts)
+					retry = true
+				}
+			}
+		}
+
+		if !retry {
+			log.Printf("No handshake response from server (attempt %d/%d)", attempt, handshakeAttempts)
+		}
+	}
+
+	return fmt.Errorf("server did not answer the handshake")
+}
+
+// initiateHandshake sends a handshake init for a key epoch and remembers it
+// as the handshake in progress. Rekeys, and reconnects while the server may
+// still hold the previous session, prove with that session's keys that they
+// come from the client that opened it.
+func (c *Client) initiateHandshake(epoch uint8) error {
+	hello := protocol.Hello{Version: protocol.Version, Capabilities: c.localCapabilities()}.Encode()
+	hs, err := crypto.NewInitiator(c.privateKey, c.serverKey, hello)
+	if err != nil {
+		return err
+	}
+	hs.SetPresharedKey(c.psk)
+
+	payload := &protocol.InitPayload{
+		Timestamp: uint64(time.Now().UnixNano()),
+		Username:  c.username,
+		Password:  c.password,
+		OTP:       c.otp,
+	}
+	if c.certificate != nil {
+		payload.Certificate = c.certificate.Marshal()
+	}
+	if current := c.keys.Current(); current != nil {
+		// Keys too old to send with cannot prove anything; servers then
+		// ask users with a second factor for a new code
+		if counter, err := current.NextCounter(); err == nil {
+			c.handshakeMu.Lock()
+			keysSession := c.keysSession
+			c.handshakeMu.Unlock()
+
+			ad := protocol.RekeyProofAD(c.sessionID.Load(), epoch, hs.LocalEphemeral())
+			payload.RekeyProof = &protocol.RekeyProof{
+				SessionID: keysSession,
+				KeyEpoch:  current.Epoch,
+				Counter:   counter,
+				Tag:       current.Encrypt(counter, nil, ad),
+			}
+		}
+	}
+	if c.kexMode != crypto.KEXClassic {
+		payload.KEMPublicKey, err = hs.GenerateKEMKey()
+		if err != nil {
+			return err
+		}
+	}
+	for _, suite := range c.suites {
+		payload.CipherSuites = append(payload.CipherSuites, uint8(suite.ID()))
+	}
+	msg, err := hs.CreateInit(payload.Encode())
+	if err != nil {
+		return err
+	}
+	init := c.cookies.AddMACs(append(hello, msg...))
+
+	c.handshakeMu.Lock()
+	c.pending = hs
+	c.pendingEpoch = epoch
+	c.pendingSent = time.Now()
+	c.handshakeMu.Unlock()
+
+	pkt := protocol.NewHandshakeInitPacket(c.sessionID.Load(), epoch, init)
+	_, err = c.conn().Write(pkt.Encode())
+	return err
+}
+
+// completeHandshake finishes the handshake in progress with the server's
+// response and starts sending with the new keys
+func (c *Client) completeHandshake(pkt *protocol.Packet) error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.pending == nil || pkt.Header.KeyEpoch != c.pendingEpoch {
+		return errNoPendingHandshake
+	}
+
+	data, err := c.pending.ConsumeResponse(pkt.Data)
+	if err != nil {
+		return err
+	}
+
+	payload, err := protocol.DecodeResponsePayload(data)
+	if err != nil {
+		return err
+	}
+
+	if payload.AuthError != 0 {
+		c.pending = nil
+		switch payload.AuthError {
+		case protocol.AuthErrorOTPRequired:
+			return ErrOTPRequired
+		case protocol.AuthErrorOTPInvalid:
+			return ErrOTPInvalid
+		}
+		return fmt.Errorf("server refused the session: %s", payload.AuthError)
+	}
+
+	kex := crypto.KEXNameClassic
+	if len(payload.KEMCiphertext) > 0 {
+		if err := c.pending.Decapsulate(payload.KEMCiphertext); err != nil {
+			return err
+		}
+		kex = crypto.KEXNameHybrid
+	} else if c.kexMode == crypto.KEXHybridOnly {
+		return fmt.Errorf("server does not support hybrid key exchange")
+	}
+
+	keys, err := c.pending.Split()
+	if err != nil {
+		return err
+	}
+	suite, err := c.chosenSuite(crypto.SuiteID(payload.CipherSuite))
+	if err != nil {
+		return err
+	}
+
+	session, err := crypto.NewSession(keys, c.pendingEpoch, suite)
+	if err != nil {
+		return err
+	}
+
+	c.keys.Install(session)
+	c.keysSession = c.sessionID.Load()
+	c.pending = nil
+	c.kex = kex
+	c.capabilities = c.localCapabilities() & payload.Capabilities
+	return nil
+}
+
+// peerCapabilities returns the protocol features both sides support
+func (c *Client) peerCapabilities() protocol.Capabilities {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+	return c.capabilities
+}
+
+// localCapabilities returns the protocol features the client supports
+func (c *Client) localCapabilities() protocol.Capabilities {
+	caps := protocol.CapCipherSuites | protocol.CapAuthErrors | protocol.CapConfigPush | protocol.CapKeepAlive
+	if c.kexMode != crypto.KEXClassic {
+		caps |= protocol.CapHybridKEX
+	}
+	return caps
+}
+
+// chosenSuite returns the offered cipher suite the server picked. A server
+// that does not name one predates negotiation and uses AES-256-GCM.
+func (c *Client) chosenSuite(id crypto.SuiteID) (crypto.CipherSuite, error) {
+	if id == 0 {
+		id = crypto.SuiteAES256GCM
+	}
+	for _, suite := range c.suites {
+		if suite.ID() == id {
+			return suite, nil
+		}
+	}
+	return nil, fmt.Errorf("server chose cipher suite %d, which was not offered", id)
+}
+
+// triggerRekey asks the keep-alive loop to start a new handshake
+func (c *Client) triggerRekey() {
+	select {
+	case c.rekeyCh <- struct{}{}:
+	default:
+	}
+}
+
+// maybeRekey starts a new handshake when the current keys are due for
+// rotation or a rekey was requested, and retransmits one that went unanswered
+func (c *Client) maybeRekey(requested bool) {
+	c.handshakeMu.Lock()
+	inProgress := c.pending != nil && time.Since(c.pendingSent) < handshakeTimeout
+	retransmit := c.pending != nil && !inProgress
+	c.handshakeMu.Unlock()
+
+	if inProgress {
+		return
+	}
+
+	session := c.keys.Current()
+	if !requested && !retransmit && !session.NeedsRekey() {
+		return
+	}
+
+	if err := c.initiateHandshake(session.Epoch + 1); err != nil {
+		log.Printf("Failed to start rekey: %v", err)
+	}
+}
+
+// receiveConfig waits for the tunnel configuration the server pushes after
+// the handshake, asking for it again if it was lost. Servers that do not
+// push one leave the tunnel to the local configuration.
+func (c *Client) receiveConfig() (*protocol.ConfigPush, error) {
+	if !c.capabilities.Has(protocol.CapConfigPush) {
+		return &protocol.ConfigPush{}, nil
+	}
+
+	buf := make([]byte, 65535)
+	conn := c.conn()
+	sessionID := c.sessionID.Load()
+	for attempt := 1; attempt <= handshakeAttempts; attempt++ {
+		deadline := time.Now().Add(configTimeout)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			pkt, err := protocol.Decode(buf[:n])
+			if err != nil || pkt.Header.SessionID != sessionID || pkt.Header.Type != protocol.PacketTypeControl {
+				continue
+			}
+			payload, ok := c.open(pkt)
+			if !ok {
+				continue
+			}
+
+			msg, err := protocol.DecodeControl(payload)
+			if err != nil {
+				return nil, err
+			}
+			switch msg := msg.(type) {
+			case *protocol.ConfigPush:
+				return msg, nil
+			case *protocol.Disconnect:
+				return nil, fmt.Errorf("server closed the session: %s", msg.Reason)
+			case *protocol.SessionError:
+				return nil, msg
+			}
+		}
+
+		log.Printf("No tunnel configuration from server (attempt %d/%d)", attempt, handshakeAttempts)
+		if err := c.sendControl(&protocol.ConfigRequest{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("server did not send the tunnel configuration")
+}
+
+// configureTUN addresses the TUN interface and brings it up. The server's
+// assignment takes precedence over the local fallback.
+func (c *Client) configureTUN(config *protocol.ConfigPush) error {
+	ip := config.TunnelIP
+	if ip == nil {
+		ip = c.tunIP
+	} else if c.tunIP != nil && !c.tunIP.Equal(ip) {
+		log.Printf("Using tunnel IP %s assigned by the server instead of %s", ip, c.tunIP)
+	}
+	if ip == nil {
+		return fmt.Errorf("the server assigned no tunnel IP and none is configured")
+	}
+
+	mask := config.Netmask
+	if mask == nil {
+		mask = c.tunMask
+	}
+	if mask == nil {
+		mask = net.CIDRMask(24, 32) // Default /24
+	}
+
+	if config.MTU != 0 && c.mtu == 0 {
+		if err := c.tun.SetMTU(int(config.MTU)); err != nil {
+			return fmt.Errorf("failed to set TUN MTU: %w", err)
+		}
+	}
+
+	if err := c.tun.SetIP(ip, mask); err != nil {
+		return fmt.Errorf("failed to set TUN IP: %w", err)
+	}
+	if err := c.tun.Up(); err != nil {
+		return fmt.Errorf("failed to bring TUN up: %w", err)
+	}
+
+	ones, _ := mask.Size()
+	log.Printf("Tunnel IP: %s/%d", ip, ones)
+	return nil
+}
+
+// setupRouting sets up routing tables. Locally configured split-tunnel
+// networks take precedence over the routes the server pushes.
+func (c *Client) setupRouting(config *protocol.ConfigPush) error {
+	networks := c.splitTunnel
+	if len(networks) == 0 {
+		networks = config.Routes
+	}
+
+	if len(config.DNS) > 0 {
+		if err := c.routing.SetDNS(config.DNS, len(networks) == 0); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if len(networks) == 0 {
+		// Full tunnel - route all traffic through VPN, except to the server
 		log.Println("Setting up full tunnel (all traffic through VPN)")
-		return c.routing.SetupDefaultRoute()
+		return c.routing.SetupDefaultRoute(c.serverUDP.IP)
 	} else {
 		// Split tunnel - only route specific networks
-		log.Printf("Setting up split tunnel for %d networks", len(c.splitTunnel))
-		return c.routing.SetupSplitTunnel(c.splitTunnel)
+		log.Printf("Setting up split tunnel for %d networks", len(networks))
+		return c.routing.SetupSplitTunnel(networks)
 	}
 }
 
@@ -204,100 +905,235 @@ func (c *Client) readFromTUN() {
 	}
 }
 
-// readFromUDP reads packets from UDP and forwards them to TUN
-func (c *Client) readFromUDP() {
-	defer c.wg.Done()
+// readFromUDP reads packets from a connection and forwards them to TUN
+// until ctx is cancelled
+func (c *Client) readFromUDP(ctx context.Context, conn *net.UDPConn) {
+	defer c.sessionWG.Done()
 
 	buf := make([]byte, 65535)
+	sessionID := c.sessionID.Load()
 
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
-			c.udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			n, err := c.udpConn.Read(buf)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					// Nothing listens on the server's port right now; the
+					// keep-alives tell when to reconnect
+					continue
+				}
 				log.Printf("Error reading from UDP: %v", err)
 				continue
 			}
 
-			// Decrypt packet
-			encrypted := buf[:n]
-			decrypted, err := c.crypto.Decrypt(encrypted)
+			// Decode protocol packet
+			pkt, err := protocol.Decode(buf[:n])
 			if err != nil {
-				log.Printf("Failed to decrypt packet: %v", err)
+				log.Printf("Failed to decode packet: %v", err)
 				continue
 			}
 
-			// Decode protocol packet
-			pkt, err := protocol.Decode(decrypted)
-			if err != nil {
-				log.Printf("Failed to decode packet: %v", err)
+			if pkt.Header.SessionID != sessionID {
+				continue
+			}
+
+			// A response to a rekey handshake
+			if pkt.Header.Type == protocol.PacketTypeHandshakeResponse {
+				if err := c.completeHandshake(pkt); err != nil {
+					if err != errNoPendingHandshake {
+						log.Printf("Rekey failed: %v", err)
+					}
+					continue
+				}
+				log.Printf("Session rekeyed (epoch: %d)", pkt.Header.KeyEpoch)
+				c.lastReceived.Store(time.Now().UnixNano())
+
+				// Using the new keys confirms them to the server
+				if err := c.sendKeepAlive(); err != nil {
+					log.Printf("Failed to send keep-alive: %v", err)
+				}
+				continue
+			}
+
+			// The server no longer accepts this client, for example after
+			// an upgrade; the session ends when its keys expire
+			if pkt.Header.Type == protocol.PacketTypeReject {
+				if reject, err := protocol.DecodeReject(pkt.Data); err == nil {
+					log.Printf("Rekey failed: %v", reject)
+				}
 				continue
 			}
 
-			// Handle data packet
-			if pkt.Header.Type == protocol.PacketTypeData {
+			// The server is under load; the rekey is retransmitted with the cookie
+			if pkt.Header.Type == protocol.PacketTypeCookieReply {
+				c.cookies.ConsumeReply(pkt.Data)
+				continue
+			}
+
+			if !pkt.IsEncrypted() {
+				continue
+			}
+
+			payload, ok := c.open(pkt)
+			if !ok {
+				continue
+			}
+			c.lastReceived.Store(time.Now().UnixNano())
+
+			switch pkt.Header.Type {
+			case protocol.PacketTypeData:
 				// Write packet data to TUN
-				if _, err := c.tun.Write(pkt.Data); err != nil {
+				if _, err := c.tun.Write(payload); err != nil {
 					log.Printf("Error writing to TUN: %v", err)
 				}
+			case protocol.PacketTypeRekey:
+				c.triggerRekey()
+			case protocol.PacketTypeControl:
+				c.handleControl(payload)
 			}
 		}
 	}
 }
 
-// sendToServer sends a packet to the server
-func (c *Client) sendToServer(data []byte) {
-	// Create protocol packet
-	pkt := protocol.NewDataPacket(c.sessionID, data)
+// open authenticates and decrypts a transport packet from the server. What
+// the cleartext header already rules out is rejected before any
+// cryptographic work is done.
+func (c *Client) open(pkt *protocol.Packet) ([]byte, bool) {
+	session := c.keys.Lookup(pkt.Header.KeyEpoch)
+	if session == nil || len(pkt.Data) < session.Overhead() {
+		return nil, false
+	}
+	if !session.Check(pkt.Header.Counter) {
+		c.replaysDropped.Add(1)
+		return nil, false
+	}
 
-	// Encode packet
-	encoded := pkt.Encode()
+	// Decrypt payload, authenticating the header
+	payload, err := session.Open(pkt.Header.Counter, pkt.Data, pkt.Header.Encode())
+	if errors.Is(err, crypto.ErrReplay) {
+		c.replaysDropped.Add(1)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to decrypt packet: %v", err)
+		return nil, false
+	}
+	return payload, true
+}
 
-	// Encrypt packet
-	encrypted, err := c.crypto.Encrypt(encoded)
+// handleControl handles control messages from the server
+func (c *Client) handleControl(payload []byte) {
+	msg, err := protocol.DecodeControl(payload)
 	if err != nil {
-		log.Printf("Failed to encrypt packet: %v", err)
+		log.Printf("Invalid control message from server: %v", err)
 		return
 	}
 
-	// Send to server
-	if _, err := c.udpConn.Write(encrypted); err != nil {
+	switch msg := msg.(type) {
+	case *protocol.Disconnect:
+		// The server is going away, for example to restart; wait for it to
+		// come back rather than leave the host without its tunnel
+		reason := msg.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		log.Printf("Server closed the session (%s), reconnecting", reason)
+		c.triggerReconnect()
+	case *protocol.SessionError:
+		c.endSession(msg)
+	case *protocol.ConfigPush:
+		// Applied once by Connect; a later push answers a request that
+		// crossed the original
+	}
+}
+
+// sendControl sends a control message to the server
+func (c *Client) sendControl(msg protocol.ControlMessage) error {
+	_, err := c.sendPacket(protocol.PacketTypeControl, protocol.EncodeControl(msg))
+	return err
+}
+
+// sendToServer sends a packet to the server. Packets are dropped while
+// the client reconnects.
+func (c *Client) sendToServer(data []byte) {
+	if !c.connected.Load() {
+		return
+	}
+
+	counter, err := c.sendPacket(protocol.PacketTypeData, data)
+	if err != nil {
+		if errors.Is(err, crypto.ErrKeyExpired) {
+			// Traffic resumes once the rekey completes
+			c.triggerRekey()
+			return
+		}
 		log.Printf("Error sending to server: %v", err)
+		return
+	}
+
+	if counter == crypto.RekeyAfterMessages {
+		c.triggerRekey()
 	}
 }
 
 // sendKeepAlive sends a keep-alive packet
 func (c *Client) sendKeepAlive() error {
-	pkt := protocol.NewKeepAlivePacket(c.sessionID)
-	encoded := pkt.Encode()
-	encrypted, err := c.crypto.Encrypt(encoded)
+	_, err := c.sendPacket(protocol.PacketTypeKeepAlive, nil)
+	return err
+}
+
+// sendPacket encrypts payload with the current keys, binding the cleartext
+// header as associated data, and sends it. It returns the counter the
+// packet was sent with.
+func (c *Client) sendPacket(t protocol.PacketType, payload []byte) (uint64, error) {
+	session := c.keys.Current()
+
+	counter, err := session.NextCounter()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = c.udpConn.Write(encrypted)
-	return err
+	pkt := protocol.NewTransportPacket(t, c.sessionID.Load(), session.Epoch, counter, len(payload)+session.Overhead())
+	pkt.Data = session.Encrypt(counter, payload, pkt.Header.Encode())
+
+	_, err = c.conn().Write(pkt.Encode())
+	return counter, err
 }
 
-// keepAlive periodically sends keep-alive packets
-func (c *Client) keepAlive() {
-	defer c.wg.Done()
+// keepAlive periodically sends keep-alive packets and rotates session keys
+// until ctx is cancelled. When the server answers keep-alives, a silence of
+// deadPeerTimeout means it is gone and the client reconnects.
+func (c *Client) keepAlive(ctx context.Context) {
+	defer c.sessionWG.Done()
 
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(keepAliveInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
+		case <-c.rekeyCh:
+			c.maybeRekey(true)
 		case <-ticker.C:
-			if err := c.sendKeepAlive(); err != nil {
+			if c.peerCapabilities().Has(protocol.CapKeepAlive) &&
+				time.Since(time.Unix(0, c.lastReceived.Load())) > deadPeerTimeout {
+				log.Println("Server is not responding, reconnecting")
+				c.triggerReconnect()
+				return
+			}
+			c.maybeRekey(false)
+			if err := c.sendKeepAlive(); err != nil && !errors.Is(err, crypto.ErrKeyExpired) {
 				log.Printf("Failed to send keep-alive: %v", err)
 			}
 		}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/nees/omail/internal/protocol"
+)
+
+// probeTimeout is how long to wait for the server's endpoints to answer pings
+const probeTimeout = time.Second
+
+// endpoint is an address of the server and how fast it answered a ping
+type endpoint struct {
+	addr *net.UDPAddr
+	rtt  time.Duration // 0 if it did not answer
+}
+
+func (e endpoint) String() string {
+	if e.rtt == 0 {
+		return fmt.Sprintf("%s (no answer to ping)", e.addr)
+	}
+	return fmt.Sprintf("%s (rtt %s)", e.addr, e.rtt.Round(time.Microsecond))
+}
+
+// resolveEndpoints resolves the configured server addresses. A host name
+// yields one endpoint per A and AAAA record.
+func (c *Client) resolveEndpoints() ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	seen := make(map[string]bool)
+	var errs []error
+
+	for _, server := range c.serverAddrs {
+		host, portStr, err := net.SplitHostPort(server)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		port, err := net.LookupPort("udp", portStr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, ip := range ips {
+			addr := &net.UDPAddr{IP: ip, Port: port}
+			if !seen[addr.String()] {
+				seen[addr.String()] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to resolve server address: %w", errors.Join(errs...))
+	}
+	return addrs, nil
+}
+
+// rankEndpoints resolves the server's endpoints and pings them all at once.
+// Endpoints that answered come first, fastest first, followed by the others
+// in configured order, except that avoid, the endpoint that just failed,
+// goes last. If the names no longer resolve, as when the kill switch blocks
+// the DNS servers while the tunnel is down, the last addresses are used.
+func (c *Client) rankEndpoints(avoid *net.UDPAddr) ([]endpoint, error) {
+	addrs, err := c.resolveEndpoints()
+	if err != nil {
+		if c.endpoints == nil {
+			return nil, err
+		}
+		log.Printf("Warning: %v; using the previous server addresses", err)
+		addrs = c.endpoints
+	}
+	c.endpoints = addrs
+
+	// The kill switch lets through exactly the endpoints about to be tried
+	if c.killSwitch {
+		if err := c.routing.SetKillSwitch(addrs); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoints := make([]endpoint, len(addrs))
+	for i, addr := range addrs {
+		endpoints[i].addr = addr
+	}
+
+	// With a single endpoint there is nothing to choose
+	if len(endpoints) > 1 {
+		if err := c.probe(endpoints); err != nil {
+			log.Printf("Failed to probe server endpoints: %v", err)
+		}
+	}
+
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if (a.rtt == 0) != (b.rtt == 0) {
+			return a.rtt != 0
+		}
+		if a.rtt != b.rtt {
+			return a.rtt < b.rtt
+		}
+		return avoid != nil && !isAddr(a.addr, avoid) && isAddr(b.addr, avoid)
+	})
+	return endpoints, nil
+}
+
+// probe pings every endpoint and records the round-trip times of those that
+// answer within probeTimeout
+func (c *Client) probe(endpoints []endpoint) error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	nonces := make([][]byte, len(endpoints))
+	sent := make([]time.Time, len(endpoints))
+	for i, e := range endpoints {
+		nonces[i] = make([]byte, protocol.PingNonceSize)
+		rand.Read(nonces[i])
+		ping := protocol.NewPingPacket(c.cookies.AddMAC1(nonces[i]))
+		sent[i] = time.Now()
+		if _, err := conn.WriteToUDP(ping.Encode(), e.addr); err != nil {
+			log.Printf("Failed to ping %s: %v", e.addr, err)
+		}
+	}
+
+	buf := make([]byte, 1500)
+	answered := 0
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	for answered < len(endpoints) {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+
+		pong, err := protocol.Decode(buf[:n])
+		if err != nil || pong.Header.Type != protocol.PacketTypePong {
+			continue
+		}
+		for i, e := range endpoints {
+			if e.rtt == 0 && isAddr(e.addr, from) && bytes.Equal(pong.Data, nonces[i]) {
+				endpoints[i].rtt = max(time.Since(sent[i]), time.Nanosecond)
+				answered++
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// connectAny establishes a session with the best endpoint of the server,
+// trying the others in turn. It returns the error of the last attempt.
+func (c *Client) connectAny() error {
+	endpoints, err := c.rankEndpoints(c.serverUDP)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range endpoints {
+		if len(endpoints) > 1 {
+			log.Printf("Connecting to endpoint %s", e)
+		}
+		if err = c.dial(e.addr); err == nil {
+			err = c.establish()
+		}
+		if err == nil || c.ctx.Err() != nil || errors.Is(err, ErrOTPRequired) || errors.Is(err, ErrOTPInvalid) {
+			return err
+		}
+		if i < len(endpoints)-1 {
+			log.Printf("Failed to connect to %s: %v", e.addr, err)
+		}
+	}
+	return err
+}
+
+// removeKillSwitch lets traffic outside the tunnel through again
+func (c *Client) removeKillSwitch() {
+	if !c.killSwitch {
+		return
+	}
+	if err := c.routing.RemoveKillSwitch(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// isAddr reports whether two UDP addresses are the same endpoint
+func isAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,228 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// MACSize is the size of the mac1 and mac2 fields appended to a handshake init
+	MACSize = 16
+	// CookieSize is the size of a cookie
+	CookieSize = 16
+	// CookieReplySize is the size of an encrypted cookie reply
+	CookieReplySize = chacha20poly1305.NonceSizeX + CookieSize + TagSize
+
+	// CookieRefreshTime is how often the server changes its cookie secret,
+	// and so how long a client may keep using a cookie
+	CookieRefreshTime = 2 * time.Minute
+)
+
+var (
+	mac1Label   = []byte("mac1----")
+	cookieLabel = []byte("cookie--")
+)
+
+// ErrInvalidCookieReply is returned for cookie replies that do not decrypt
+// or do not answer the last handshake init sent
+var ErrInvalidCookieReply = errors.New("invalid cookie reply")
+
+// A handshake init carries two MACs after the Noise message:
+//
+//	mac1 = MAC(HASH("mac1----" || server public key), msg)
+//	mac2 = MAC(cookie, msg || mac1), or zeros without a cookie
+//
+// mac1 lets the server drop inits from anyone who does not know its public
+// key before doing any Diffie-Hellman work. Under load the server also
+// requires a valid mac2: inits without one are answered with a cookie reply
+// instead, and the cookie, being a MAC of the sender's address under a
+// rotating secret, proves the sender can receive packets at that address.
+
+// CookieChecker validates handshake MACs and issues cookies on the server
+type CookieChecker struct {
+	mac1Key   []byte
+	cookieKey []byte
+
+	mu            sync.Mutex
+	secret        []byte
+	secretCreated time.Time
+}
+
+// NewCookieChecker creates a cookie checker for the server's static key
+func NewCookieChecker(server PublicKey) *CookieChecker {
+	return &CookieChecker{
+		mac1Key:   labelKey(mac1Label, server),
+		cookieKey: labelKey(cookieLabel, server),
+	}
+}
+
+// SplitMACs splits a handshake init into the Noise message and its MACs
+func SplitMACs(msg []byte) (body, mac1, mac2 []byte, ok bool) {
+	if len(msg) < 2*MACSize {
+		return nil, nil, nil, false
+	}
+	n := len(msg) - 2*MACSize
+	return msg[:n], msg[n : n+MACSize], msg[n+MACSize:], true
+}
+
+// CheckMAC1 reports whether a handshake init carries a valid mac1
+func (c *CookieChecker) CheckMAC1(msg []byte) bool {
+	body, mac1, _, ok := SplitMACs(msg)
+	if !ok {
+		return false
+	}
+	return hmac.Equal(mac1, mac(c.mac1Key, body))
+}
+
+// CheckMAC2 reports whether a handshake init carries a valid mac2 for a
+// cookie issued to the given source address
+func (c *CookieChecker) CheckMAC2(msg, addr []byte) bool {
+	body, mac1, mac2, ok := SplitMACs(msg)
+	if !ok {
+		return false
+	}
+	cookie := mac(c.currentSecret(), addr)
+	return hmac.Equal(mac2, mac(cookie, body, mac1))
+}
+
+// CreateReply creates an encrypted cookie reply for a handshake init from
+// the given source address. The init's mac1 is bound as associated data so
+// the client can tell which init the reply answers.
+func (c *CookieChecker) CreateReply(msg, addr []byte) ([]byte, error) {
+	_, mac1, _, ok := SplitMACs(msg)
+	if !ok {
+		return nil, errors.New("handshake init too short")
+	}
+
+	aead, err := chacha20poly1305.NewX(c.cookieKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	cookie := mac(c.currentSecret(), addr)
+	return aead.Seal(nonce, nonce, cookie, mac1), nil
+}
+
+// currentSecret returns the cookie secret, replacing it once it has aged
+func (c *CookieChecker) currentSecret() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.secret == nil || time.Since(c.secretCreated) > CookieRefreshTime {
+		secret := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			panic(err)
+		}
+		c.secret = secret
+		c.secretCreated = time.Now()
+	}
+	return c.secret
+}
+
+// CookieGenerator adds MACs to handshake inits and stores cookies on the client
+type CookieGenerator struct {
+	mac1Key   []byte
+	cookieKey []byte
+
+	mu            sync.Mutex
+	lastMAC1      []byte
+	cookie        []byte
+	cookieCreated time.Time
+}
+
+// NewCookieGenerator creates a cookie generator for a server's static key
+func NewCookieGenerator(server PublicKey) *CookieGenerator {
+	return &CookieGenerator{
+		mac1Key:   labelKey(mac1Label, server),
+		cookieKey: labelKey(cookieLabel, server),
+	}
+}
+
+// AddMACs appends mac1 and mac2 to a handshake init. mac2 is only filled
+// in while the generator holds a cookie that has not expired.
+func (g *CookieGenerator) AddMACs(msg []byte) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mac1 := mac(g.mac1Key, msg)
+	g.lastMAC1 = mac1
+
+	mac2 := make([]byte, MACSize)
+	if g.cookie != nil && time.Since(g.cookieCreated) < CookieRefreshTime {
+		mac2 = mac(g.cookie, msg, mac1)
+	}
+
+	out := make([]byte, 0, len(msg)+2*MACSize)
+	out = append(out, msg...)
+	out = append(out, mac1...)
+	return append(out, mac2...)
+}
+
+// AddMAC1 appends mac1 and an empty mac2 to a message other than a
+// handshake init, such as a ping. Unlike AddMACs it leaves the cookie state
+// of the handshake alone.
+func (g *CookieGenerator) AddMAC1(msg []byte) []byte {
+	out := make([]byte, 0, len(msg)+2*MACSize)
+	out = append(out, msg...)
+	out = append(out, mac(g.mac1Key, msg)...)
+	return append(out, make([]byte, MACSize)...)
+}
+
+// ConsumeReply decrypts a cookie reply to the last handshake init sent and
+// stores its cookie for the next init
+func (g *CookieGenerator) ConsumeReply(reply []byte) error {
+	if len(reply) != CookieReplySize {
+		return ErrInvalidCookieReply
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.lastMAC1 == nil {
+		return ErrInvalidCookieReply
+	}
+
+	aead, err := chacha20poly1305.NewX(g.cookieKey)
+	if err != nil {
+		return err
+	}
+
+	nonce := reply[:chacha20poly1305.NonceSizeX]
+	cookie, err := aead.Open(nil, nonce, reply[chacha20poly1305.NonceSizeX:], g.lastMAC1)
+	if err != nil {
+		return ErrInvalidCookieReply
+	}
+
+	g.cookie = cookie
+	g.cookieCreated = time.Now()
+	return nil
+}
+
+// labelKey derives a MAC or cookie key from a label and the server key
+func labelKey(label []byte, server PublicKey) []byte {
+	hash := sha256.New()
+	hash.Write(label)
+	hash.Write(server[:])
+	return hash.Sum(nil)
+}
+
+// mac computes a truncated HMAC-SHA256 over the concatenation of data
+func mac(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)[:MACSize]
+}
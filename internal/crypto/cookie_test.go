@@ -0,0 +1,187 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	cookieAddr      = []byte{192, 0, 2, 1, 0xca, 0x6c}
+	otherCookieAddr = []byte{192, 0, 2, 2, 0xca, 0x6c}
+)
+
+// cookiePair returns a client cookie generator and a server cookie checker
+// for the same server key
+func cookiePair(t *testing.T) (*CookieGenerator, *CookieChecker) {
+	t.Helper()
+
+	server, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCookieGenerator(server.PublicKey()), NewCookieChecker(server.PublicKey())
+}
+
+// withCookie gives a generator a cookie issued for cookieAddr
+func withCookie(t *testing.T, generator *CookieGenerator, checker *CookieChecker) {
+	t.Helper()
+
+	reply, err := checker.CreateReply(generator.AddMACs([]byte("init")), cookieAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generator.ConsumeReply(reply); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCookieMAC1(t *testing.T) {
+	generator, checker := cookiePair(t)
+	_, otherChecker := cookiePair(t)
+
+	msg := generator.AddMACs([]byte("init"))
+	if !checker.CheckMAC1(msg) {
+		t.Fatal("valid mac1 rejected")
+	}
+	if otherChecker.CheckMAC1(msg) {
+		t.Fatal("mac1 for another server key accepted")
+	}
+
+	tampered := append([]byte(nil), msg...)
+	tampered[0] ^= 1
+	if checker.CheckMAC1(tampered) {
+		t.Fatal("mac1 of a tampered init accepted")
+	}
+	if checker.CheckMAC1(msg[:2*MACSize-1]) {
+		t.Fatal("init shorter than its MACs accepted")
+	}
+
+	if !checker.CheckMAC1(generator.AddMAC1([]byte("ping"))) {
+		t.Fatal("valid mac1 of a ping rejected")
+	}
+}
+
+func TestCookieMAC2WithoutCookie(t *testing.T) {
+	generator, checker := cookiePair(t)
+
+	msg := generator.AddMACs([]byte("init"))
+	_, _, mac2, _ := SplitMACs(msg)
+	for _, b := range mac2 {
+		if b != 0 {
+			t.Fatal("mac2 filled in without a cookie")
+		}
+	}
+	if checker.CheckMAC2(msg, cookieAddr) {
+		t.Fatal("init without a cookie passed mac2")
+	}
+}
+
+func TestCookieReplyRoundTrip(t *testing.T) {
+	generator, checker := cookiePair(t)
+	withCookie(t, generator, checker)
+
+	msg := generator.AddMACs([]byte("second init"))
+	if !checker.CheckMAC1(msg) {
+		t.Fatal("valid mac1 rejected")
+	}
+	if !checker.CheckMAC2(msg, cookieAddr) {
+		t.Fatal("valid mac2 rejected")
+	}
+
+	tampered := append([]byte(nil), msg...)
+	tampered[len(tampered)-1] ^= 1
+	if checker.CheckMAC2(tampered, cookieAddr) {
+		t.Fatal("tampered mac2 accepted")
+	}
+}
+
+func TestCookieBoundToAddress(t *testing.T) {
+	generator, checker := cookiePair(t)
+	withCookie(t, generator, checker)
+
+	msg := generator.AddMACs([]byte("second init"))
+	if checker.CheckMAC2(msg, otherCookieAddr) {
+		t.Fatal("cookie accepted from another address")
+	}
+}
+
+func TestCookieReplyRejected(t *testing.T) {
+	generator, checker := cookiePair(t)
+	otherGenerator, _ := cookiePair(t)
+
+	if err := generator.ConsumeReply(make([]byte, CookieReplySize)); err != ErrInvalidCookieReply {
+		t.Fatalf("reply before any init: got %v", err)
+	}
+
+	first := generator.AddMACs([]byte("first init"))
+	reply, err := checker.CreateReply(first, cookieAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generator.ConsumeReply(reply[:len(reply)-1]); err != ErrInvalidCookieReply {
+		t.Fatalf("short reply: got %v", err)
+	}
+	tampered := append([]byte(nil), reply...)
+	tampered[len(tampered)-1] ^= 1
+	if err := generator.ConsumeReply(tampered); err != ErrInvalidCookieReply {
+		t.Fatalf("tampered reply: got %v", err)
+	}
+
+	// A reply is only valid for the server key it was made under
+	otherGenerator.AddMACs([]byte("first init"))
+	if err := otherGenerator.ConsumeReply(reply); err != ErrInvalidCookieReply {
+		t.Fatalf("reply for another server key: got %v", err)
+	}
+
+	// Pings do not replace the init a reply answers, newer inits do
+	generator.AddMAC1([]byte("ping"))
+	if err := generator.ConsumeReply(reply); err != nil {
+		t.Fatalf("reply after a ping: %v", err)
+	}
+	generator.AddMACs([]byte("second init"))
+	if err := generator.ConsumeReply(reply); err != ErrInvalidCookieReply {
+		t.Fatalf("reply to an older init: got %v", err)
+	}
+
+	if _, err := checker.CreateReply(first[:2*MACSize-1], cookieAddr); err == nil {
+		t.Fatal("reply created for an init shorter than its MACs")
+	}
+}
+
+func TestCookieSecretRotation(t *testing.T) {
+	generator, checker := cookiePair(t)
+	withCookie(t, generator, checker)
+
+	// The server's secret changes: cookies issued under the old one no
+	// longer pass
+	checker.mu.Lock()
+	checker.secretCreated = time.Now().Add(-CookieRefreshTime - time.Second)
+	checker.mu.Unlock()
+	if checker.CheckMAC2(generator.AddMACs([]byte("init")), cookieAddr) {
+		t.Fatal("cookie accepted after the secret changed")
+	}
+
+	// A cookie under the new secret passes again
+	withCookie(t, generator, checker)
+	if !checker.CheckMAC2(generator.AddMACs([]byte("init")), cookieAddr) {
+		t.Fatal("cookie under the new secret rejected")
+	}
+}
+
+func TestCookieExpiresOnClient(t *testing.T) {
+	generator, checker := cookiePair(t)
+	withCookie(t, generator, checker)
+
+	generator.mu.Lock()
+	generator.cookieCreated = time.Now().Add(-CookieRefreshTime)
+	generator.mu.Unlock()
+
+	msg := generator.AddMACs([]byte("init"))
+	_, _, mac2, _ := SplitMACs(msg)
+	for _, b := range mac2 {
+		if b != 0 {
+			t.Fatal("mac2 filled in with an expired cookie")
+		}
+	}
+}
@@ -1,91 +1,56 @@
 package crypto
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
+	"encoding/binary"
 	"errors"
-	"io"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
-	// KeySize is the size of the encryption key in bytes (AES-256)
+	// KeySize is the size of the encryption key in bytes (256 bits for every suite)
 	KeySize = 32
-	// NonceSize is the size of the nonce for GCM (12 bytes recommended)
+	// NonceSize is the size of the nonce for GCM and ChaCha20-Poly1305
 	NonceSize = 12
-	// SaltSize is the size of the salt for key derivation
-	SaltSize = 16
 )
 
 // Crypto handles encryption and decryption of VPN packets
 type Crypto struct {
-	aead cipher.AEAD
-}
-
-// NewCrypto creates a new crypto instance from a password
-func NewCrypto(password string) (*Crypto, error) {
-	// Derive key from password using PBKDF2
-	salt := make([]byte, SaltSize)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return nil, err
-	}
-
-	key := pbkdf2.Key([]byte(password), salt, 4096, KeySize, sha256.New)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Crypto{aead: aead}, nil
+	suite CipherSuite
+	aead  cipher.AEAD
 }
 
-// NewCryptoFromKey creates a new crypto instance from a raw key
-func NewCryptoFromKey(key []byte) (*Crypto, error) {
+// NewCryptoFromKey creates a new crypto instance for a cipher suite from a raw key
+func NewCryptoFromKey(suite CipherSuite, key []byte) (*Crypto, error) {
 	if len(key) != KeySize {
 		return nil, errors.New("invalid key size")
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	aead, err := cipher.NewGCM(block)
+	aead, err := suite.NewAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Crypto{aead: aead}, nil
+	return &Crypto{suite: suite, aead: aead}, nil
 }
 
-// Encrypt encrypts plaintext and returns ciphertext with nonce prepended
-func (c *Crypto) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, NonceSize)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
+// Suite returns the cipher suite in use
+func (c *Crypto) Suite() CipherSuite {
+	return c.suite
+}
 
-	ciphertext := c.aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+// Encrypt encrypts plaintext using the packet counter as the nonce and
+// authenticates ad alongside it. A counter must never be reused with the same key.
+func (c *Crypto) Encrypt(counter uint64, plaintext, ad []byte) []byte {
+	return c.aead.Seal(nil, counterNonce(c.aead.NonceSize(), counter), plaintext, ad)
 }
 
-// Decrypt decrypts ciphertext (with nonce prepended) and returns plaintext
-func (c *Crypto) Decrypt(ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < NonceSize {
+// Decrypt decrypts ciphertext that was sealed with the given counter and ad
+func (c *Crypto) Decrypt(counter uint64, ciphertext, ad []byte) ([]byte, error) {
+	if len(ciphertext) < c.aead.Overhead() {
 		return nil, errors.New("ciphertext too short")
 	}
 
-	nonce, ciphertext := ciphertext[:NonceSize], ciphertext[NonceSize:]
-	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := c.aead.Open(nil, counterNonce(c.aead.NonceSize(), counter), ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +58,15 @@ func (c *Crypto) Decrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// Overhead returns the encryption overhead (nonce + GCM tag)
+// Overhead returns the encryption overhead (authentication tag)
 func (c *Crypto) Overhead() int {
-	return NonceSize + c.aead.Overhead()
+	return c.aead.Overhead()
+}
+
+// counterNonce encodes a packet counter as an AEAD nonce of the given size:
+// zero bytes followed by the big-endian counter
+func counterNonce(size int, counter uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
 }
@@ -0,0 +1,392 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	// PublicKeySize is the size of an X25519 public key in bytes
+	PublicKeySize = 32
+	// TagSize is the size of an AEAD authentication tag in bytes
+	TagSize = 16
+	// HandshakeInitOverhead is the size of a handshake init message without its payload
+	HandshakeInitOverhead = PublicKeySize + PublicKeySize + TagSize + TagSize
+	// HandshakeResponseOverhead is the size of a handshake response message without its payload
+	HandshakeResponseOverhead = PublicKeySize + TagSize
+)
+
+const noiseProtocolName = "Noise_IKpsk2_25519_AESGCM_SHA256"
+
+var noisePrologue = []byte("omail v1")
+
+// SessionKeys holds the directional transport keys derived by a handshake
+type SessionKeys struct {
+	Send    []byte
+	Receive []byte
+}
+
+// Handshake is one side of a Noise_IKpsk2 handshake.
+//
+// The client (initiator) already knows the server's static public key. Its
+// first message carries its own static key and a payload, both encrypted and
+// authenticated by the ephemeral-static and static-static DH results. The
+// server's response completes the ephemeral-ephemeral and static-ephemeral
+// exchanges and mixes in the pre-shared key. In hybrid mode the init payload
+// also carries an ML-KEM-768 encapsulation key and the response payload its
+// ciphertext. Both sides then mix in the KEM secret, if any, and split the
+// chaining key into transport keys.
+//
+// The pre-shared key is optional and all zeros when not configured. A secret
+// one keeps recorded sessions confidential even against an attacker who can
+// later break X25519, for example with a quantum computer.
+type Handshake struct {
+	state           symmetricState
+	localStatic     *ecdh.PrivateKey
+	localEphemeral  *ecdh.PrivateKey
+	remoteStatic    *ecdh.PublicKey
+	remoteEphemeral *ecdh.PublicKey
+	psk             PresharedKey
+	kemKey          *mlkem.DecapsulationKey768
+	kemSecret       []byte
+	initiator       bool
+	done            bool
+}
+
+// NewInitiator creates the client side of a handshake with the given server.
+// The prologue is any cleartext sent alongside the handshake; the responder
+// must pass the same bytes or the handshake fails.
+func NewInitiator(local PrivateKey, server PublicKey, prologue []byte) (*Handshake, error) {
+	localStatic, err := ecdh.X25519().NewPrivateKey(local[:])
+	if err != nil {
+		return nil, err
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(server[:])
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handshake{
+		localStatic:    localStatic,
+		localEphemeral: ephemeral,
+		remoteStatic:   remoteStatic,
+		initiator:      true,
+	}
+	h.state.init(prologue)
+	h.state.mixHash(server[:])
+	return h, nil
+}
+
+// NewResponder creates the server side of a handshake with the prologue the
+// initiator sent
+func NewResponder(local PrivateKey, prologue []byte) (*Handshake, error) {
+	localStatic, err := ecdh.X25519().NewPrivateKey(local[:])
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handshake{localStatic: localStatic}
+	h.state.init(prologue)
+	h.state.mixHash(localStatic.PublicKey().Bytes())
+	return h, nil
+}
+
+// SetPresharedKey sets the pre-shared key mixed into the handshake. The
+// initiator sets it before consuming the response; the responder after
+// consuming the init, once PeerStatic identifies the client.
+func (h *Handshake) SetPresharedKey(psk PresharedKey) {
+	h.psk = psk
+}
+
+// CreateInit builds the initiator's message: e, es, s, ss, payload
+func (h *Handshake) CreateInit(payload []byte) ([]byte, error) {
+	if !h.initiator {
+		return nil, errors.New("responder cannot create a handshake init")
+	}
+
+	ephemeral := h.localEphemeral
+	msg := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	h.state.mixEphemeral(ephemeral.PublicKey().Bytes())
+
+	if err := h.mixDH(ephemeral, h.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	encryptedStatic, err := h.state.encryptAndHash(h.localStatic.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, encryptedStatic...)
+
+	if err := h.mixDH(h.localStatic, h.remoteStatic); err != nil {
+		return nil, err
+	}
+
+	encryptedPayload, err := h.state.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, encryptedPayload...), nil
+}
+
+// ConsumeInit processes the initiator's message and returns its payload.
+// The initiator's static key is available from PeerStatic afterwards.
+func (h *Handshake) ConsumeInit(msg []byte) ([]byte, error) {
+	if h.initiator {
+		return nil, errors.New("initiator cannot consume a handshake init")
+	}
+	if len(msg) < HandshakeInitOverhead {
+		return nil, errors.New("handshake init too short")
+	}
+
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(msg[:PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	h.remoteEphemeral = remoteEphemeral
+	h.state.mixEphemeral(msg[:PublicKeySize])
+
+	if err := h.mixDH(h.localStatic, remoteEphemeral); err != nil {
+		return nil, err
+	}
+
+	static, err := h.state.decryptAndHash(msg[PublicKeySize : 2*PublicKeySize+TagSize])
+	if err != nil {
+		return nil, errors.New("handshake init authentication failed")
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(static)
+	if err != nil {
+		return nil, err
+	}
+	h.remoteStatic = remoteStatic
+
+	if err := h.mixDH(h.localStatic, remoteStatic); err != nil {
+		return nil, err
+	}
+
+	payload, err := h.state.decryptAndHash(msg[2*PublicKeySize+TagSize:])
+	if err != nil {
+		return nil, errors.New("handshake init authentication failed")
+	}
+	return payload, nil
+}
+
+// CreateResponse builds the responder's message: e, ee, se, psk, payload
+func (h *Handshake) CreateResponse(payload []byte) ([]byte, error) {
+	if h.initiator || h.remoteEphemeral == nil {
+		return nil, errors.New("handshake init has not been consumed")
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h.localEphemeral = ephemeral
+
+	msg := append([]byte(nil), ephemeral.PublicKey().Bytes()...)
+	h.state.mixEphemeral(ephemeral.PublicKey().Bytes())
+
+	if err := h.mixDH(ephemeral, h.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if err := h.mixDH(ephemeral, h.remoteStatic); err != nil {
+		return nil, err
+	}
+	h.state.mixKeyAndHash(h.psk[:])
+
+	encryptedPayload, err := h.state.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	h.done = true
+	return append(msg, encryptedPayload...), nil
+}
+
+// ConsumeResponse processes the responder's message and returns its payload
+func (h *Handshake) ConsumeResponse(msg []byte) ([]byte, error) {
+	if !h.initiator || h.localEphemeral == nil {
+		return nil, errors.New("handshake init has not been sent")
+	}
+	if len(msg) < HandshakeResponseOverhead {
+		return nil, errors.New("handshake response too short")
+	}
+
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(msg[:PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	h.remoteEphemeral = remoteEphemeral
+	h.state.mixEphemeral(msg[:PublicKeySize])
+
+	if err := h.mixDH(h.localEphemeral, remoteEphemeral); err != nil {
+		return nil, err
+	}
+	if err := h.mixDH(h.localStatic, remoteEphemeral); err != nil {
+		return nil, err
+	}
+	h.state.mixKeyAndHash(h.psk[:])
+
+	payload, err := h.state.decryptAndHash(msg[PublicKeySize:])
+	if err != nil {
+		return nil, errors.New("handshake response authentication failed")
+	}
+	h.done = true
+	return payload, nil
+}
+
+// Split derives this side's session keys once the response has been
+// created or consumed, mixing in the ML-KEM secret of a hybrid handshake
+func (h *Handshake) Split() (*SessionKeys, error) {
+	if !h.done {
+		return nil, errors.New("handshake is not complete")
+	}
+
+	if h.kemSecret != nil {
+		h.state.mixKey(h.kemSecret)
+	}
+
+	initiatorKey, responderKey := h.state.split()
+	if h.initiator {
+		return &SessionKeys{Send: initiatorKey, Receive: responderKey}, nil
+	}
+	return &SessionKeys{Send: responderKey, Receive: initiatorKey}, nil
+}
+
+// LocalEphemeral returns the initiator's ephemeral public key, which opens
+// its init message in the clear. It is known before the init is created, so
+// that the payload can be bound to this handshake.
+func (h *Handshake) LocalEphemeral() []byte {
+	return h.localEphemeral.PublicKey().Bytes()
+}
+
+// PeerStatic returns the remote party's static public key
+func (h *Handshake) PeerStatic() PublicKey {
+	var key PublicKey
+	if h.remoteStatic != nil {
+		copy(key[:], h.remoteStatic.Bytes())
+	}
+	return key
+}
+
+// mixDH mixes a Diffie-Hellman result into the chaining key
+func (h *Handshake) mixDH(private *ecdh.PrivateKey, public *ecdh.PublicKey) error {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return err
+	}
+	h.state.mixKey(shared)
+	return nil
+}
+
+// symmetricState is the Noise SymmetricState (chaining key, handshake hash and cipher)
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+}
+
+func (s *symmetricState) init(prologue []byte) {
+	s.h = make([]byte, sha256.Size)
+	copy(s.h, noiseProtocolName)
+	s.ck = append([]byte(nil), s.h...)
+	s.mixHash(append(append([]byte(nil), noisePrologue...), prologue...))
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(s.h)
+	hash.Write(data)
+	s.h = hash.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(input []byte) {
+	out := noiseHKDF(s.ck, input, 2)
+	s.ck, s.k, s.n = out[0], out[1], 0
+}
+
+// mixKeyAndHash mixes a pre-shared key into both the chaining key and the
+// handshake hash
+func (s *symmetricState) mixKeyAndHash(input []byte) {
+	out := noiseHKDF(s.ck, input, 3)
+	s.ck = out[0]
+	s.mixHash(out[1])
+	s.k, s.n = out[2], 0
+}
+
+// mixEphemeral processes an "e" token. Handshakes with a PSK also mix the
+// ephemeral key into the chaining key, as the Noise specification requires.
+func (s *symmetricState) mixEphemeral(public []byte) {
+	s.mixHash(public)
+	out := noiseHKDF(s.ck, public, 1)
+	s.ck = out[0]
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	aead, err := newNoiseCipher(s.k)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := aead.Seal(nil, counterNonce(NonceSize, s.n), plaintext, s.h)
+	s.n++
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, err := newNoiseCipher(s.k)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, counterNonce(NonceSize, s.n), ciphertext, s.h)
+	if err != nil {
+		return nil, err
+	}
+	s.n++
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (s *symmetricState) split() ([]byte, []byte) {
+	out := noiseHKDF(s.ck, nil, 2)
+	return out[0], out[1]
+}
+
+// noiseHKDF is the HKDF function from the Noise specification
+func noiseHKDF(chainingKey, input []byte, outputs int) [][]byte {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(input)
+	tempKey := mac.Sum(nil)
+
+	var out [][]byte
+	var prev []byte
+	for i := 1; i <= outputs; i++ {
+		mac := hmac.New(sha256.New, tempKey)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i)})
+		prev = mac.Sum(nil)
+		out = append(out, prev)
+	}
+	return out
+}
+
+func newNoiseCipher(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, errors.New("handshake cipher has no key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// handshakeKeys returns a client and a server static key
+func handshakeKeys(t *testing.T) (PrivateKey, PrivateKey) {
+	t.Helper()
+
+	client, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+	prologue := []byte("hello")
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), prologue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit([]byte("init payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:PublicKeySize], initiator.LocalEphemeral()) {
+		t.Fatal("init does not open with the local ephemeral key")
+	}
+
+	responder, err := NewResponder(serverKey, prologue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := responder.ConsumeInit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("init payload")) {
+		t.Fatalf("init payload: got %q", payload)
+	}
+	if responder.PeerStatic() != clientKey.PublicKey() {
+		t.Fatal("responder did not learn the client key")
+	}
+
+	reply, err := responder.CreateResponse([]byte("response payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err = initiator.ConsumeResponse(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("response payload")) {
+		t.Fatalf("response payload: got %q", payload)
+	}
+
+	clientKeys, err := initiator.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKeys, err := responder.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKeys.Send, serverKeys.Receive) || !bytes.Equal(clientKeys.Receive, serverKeys.Send) {
+		t.Fatal("the two sides derived different keys")
+	}
+	if bytes.Equal(clientKeys.Send, clientKeys.Receive) {
+		t.Fatal("both directions use the same key")
+	}
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+	_, otherKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, otherKey.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := NewResponder(serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.ConsumeInit(msg); err == nil {
+		t.Fatal("init for another server accepted")
+	}
+}
+
+func TestHandshakePrologueMismatch(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := NewResponder(serverKey, []byte("tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.ConsumeInit(msg); err == nil {
+		t.Fatal("init with a tampered prologue accepted")
+	}
+}
+
+func TestHandshakeTamperedInit(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg[len(msg)-1] ^= 1
+
+	responder, err := NewResponder(serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.ConsumeInit(msg); err == nil {
+		t.Fatal("tampered init accepted")
+	}
+}
+
+func TestHandshakePresharedKey(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+	psk, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		client     PresharedKey
+		server     PresharedKey
+		wantFailed bool
+	}{
+		{"same key", psk, psk, false},
+		{"different keys", psk, other, true},
+		{"client only", psk, PresharedKey{}, true},
+		{"server only", PresharedKey{}, psk, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			initiator.SetPresharedKey(tt.client)
+			msg, err := initiator.CreateInit(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The init does not depend on the key, so the server can look
+			// it up by the client's static key
+			responder, err := NewResponder(serverKey, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := responder.ConsumeInit(msg); err != nil {
+				t.Fatal(err)
+			}
+			responder.SetPresharedKey(tt.server)
+			reply, err := responder.CreateResponse(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = initiator.ConsumeResponse(reply)
+			if failed := err != nil; failed != tt.wantFailed {
+				t.Fatalf("ConsumeResponse: got %v, want failure %v", err, tt.wantFailed)
+			}
+		})
+	}
+}
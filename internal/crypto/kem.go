@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KEXMode selects whether handshakes add an ML-KEM-768 encapsulation to the
+// X25519 exchanges. The shared secrets of both are mixed into the session
+// keys, which stay secret as long as either primitive holds.
+type KEXMode uint8
+
+const (
+	// KEXHybrid uses ML-KEM-768 + X25519 when the peer supports it and
+	// falls back to X25519 alone otherwise
+	KEXHybrid KEXMode = iota
+	// KEXClassic uses X25519 alone
+	KEXClassic
+	// KEXHybridOnly refuses peers that do not support ML-KEM-768
+	KEXHybridOnly
+)
+
+// String returns the name of the mode as accepted by ParseKEXMode
+func (m KEXMode) String() string {
+	switch m {
+	case KEXHybrid:
+		return "hybrid"
+	case KEXClassic:
+		return "classic"
+	case KEXHybridOnly:
+		return "hybrid-only"
+	}
+	return fmt.Sprintf("KEXMode(%d)", m)
+}
+
+// ParseKEXMode parses "hybrid", "classic" or "hybrid-only"
+func ParseKEXMode(s string) (KEXMode, error) {
+	for _, m := range []KEXMode{KEXHybrid, KEXClassic, KEXHybridOnly} {
+		if strings.EqualFold(s, m.String()) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key exchange mode: %s", s)
+}
+
+// Names of the key exchanges, for logging
+const (
+	KEXNameClassic = "x25519"
+	KEXNameHybrid  = "x25519+mlkem768"
+)
+
+// GenerateKEMKey generates an ML-KEM-768 key pair for a hybrid handshake and
+// returns the encapsulation key to send to the responder in the init payload
+func (h *Handshake) GenerateKEMKey() ([]byte, error) {
+	if !h.initiator {
+		return nil, errors.New("only the initiator generates a KEM key")
+	}
+
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	h.kemKey = dk
+	return dk.EncapsulationKey().Bytes(), nil
+}
+
+// Encapsulate creates a shared secret for the initiator's encapsulation key
+// and returns the ciphertext to send back in the response payload. The
+// secret is mixed into the session keys by Split.
+func (h *Handshake) Encapsulate(encapsulationKey []byte) ([]byte, error) {
+	if h.initiator {
+		return nil, errors.New("only the responder encapsulates")
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KEM encapsulation key: %w", err)
+	}
+
+	sharedKey, ciphertext := ek.Encapsulate()
+	h.kemSecret = sharedKey
+	return ciphertext, nil
+}
+
+// Decapsulate recovers the shared secret from the responder's ciphertext.
+// The secret is mixed into the session keys by Split.
+func (h *Handshake) Decapsulate(ciphertext []byte) error {
+	if h.kemKey == nil {
+		return errors.New("no KEM key was offered")
+	}
+
+	sharedKey, err := h.kemKey.Decapsulate(ciphertext)
+	if err != nil {
+		return fmt.Errorf("invalid KEM ciphertext: %w", err)
+	}
+	h.kemSecret = sharedKey
+	return nil
+}
+
+// Hybrid reports whether an ML-KEM-768 secret will be mixed into the session keys
+func (h *Handshake) Hybrid() bool {
+	return h.kemSecret != nil
+}
@@ -0,0 +1,175 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// hybridHandshake runs a handshake in which the initiator offers an ML-KEM
+// key and the responder encapsulates to it. tamper, if set, is applied to the
+// KEM ciphertext before the initiator decapsulates it.
+func hybridHandshake(t *testing.T, tamper func([]byte)) (*SessionKeys, *SessionKeys) {
+	t.Helper()
+	clientKey, serverKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encapsulationKey, err := initiator.GenerateKEMKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit(encapsulationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := NewResponder(serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := responder.ConsumeInit(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := responder.Encapsulate(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !responder.Hybrid() {
+		t.Fatal("responder is not hybrid after encapsulating")
+	}
+	reply, err := responder.CreateResponse(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err = initiator.ConsumeResponse(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(payload)
+	}
+	if err := initiator.Decapsulate(payload); err != nil {
+		t.Fatal(err)
+	}
+	if !initiator.Hybrid() {
+		t.Fatal("initiator is not hybrid after decapsulating")
+	}
+
+	clientKeys, err := initiator.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKeys, err := responder.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientKeys, serverKeys
+}
+
+func TestHybridHandshakeRoundTrip(t *testing.T) {
+	clientKeys, serverKeys := hybridHandshake(t, nil)
+
+	if !bytes.Equal(clientKeys.Send, serverKeys.Receive) || !bytes.Equal(clientKeys.Receive, serverKeys.Send) {
+		t.Fatal("the two sides derived different keys")
+	}
+	if bytes.Equal(clientKeys.Send, clientKeys.Receive) {
+		t.Fatal("both directions use the same key")
+	}
+}
+
+func TestHybridHandshakeTamperedCiphertext(t *testing.T) {
+	// ML-KEM rejects implicitly: a tampered ciphertext decapsulates to an
+	// unrelated secret, so the session keys no longer match
+	clientKeys, serverKeys := hybridHandshake(t, func(ciphertext []byte) {
+		ciphertext[0] ^= 1
+	})
+
+	if bytes.Equal(clientKeys.Send, serverKeys.Receive) {
+		t.Fatal("keys match after the KEM ciphertext was tampered with")
+	}
+}
+
+func TestHybridHandshakeClassicResponder(t *testing.T) {
+	// A responder that ignores the KEM key falls back to X25519 alone
+	clientKey, serverKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encapsulationKey, err := initiator.GenerateKEMKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := initiator.CreateInit(encapsulationKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := NewResponder(serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.ConsumeInit(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := responder.CreateResponse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initiator.ConsumeResponse(reply); err != nil {
+		t.Fatal(err)
+	}
+	if initiator.Hybrid() || responder.Hybrid() {
+		t.Fatal("handshake without a KEM ciphertext reported as hybrid")
+	}
+
+	clientKeys, err := initiator.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKeys, err := responder.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(clientKeys.Send, serverKeys.Receive) || !bytes.Equal(clientKeys.Receive, serverKeys.Send) {
+		t.Fatal("the two sides derived different keys")
+	}
+}
+
+func TestKEMRoles(t *testing.T) {
+	clientKey, serverKey := handshakeKeys(t)
+
+	initiator, err := NewInitiator(clientKey, serverKey.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewResponder(serverKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := responder.GenerateKEMKey(); err == nil {
+		t.Fatal("responder generated a KEM key")
+	}
+	if _, err := initiator.Encapsulate(nil); err == nil {
+		t.Fatal("initiator encapsulated")
+	}
+	if err := initiator.Decapsulate(make([]byte, 1088)); err == nil {
+		t.Fatal("decapsulated without offering a KEM key")
+	}
+	if _, err := responder.Encapsulate([]byte("short")); err == nil {
+		t.Fatal("invalid encapsulation key accepted")
+	}
+
+	if _, err := initiator.GenerateKEMKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Decapsulate([]byte("short")); err == nil {
+		t.Fatal("invalid KEM ciphertext accepted")
+	}
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"sync"
+	"time"
+)
+
+// RekeyGracePeriod is how long the previous session stays usable for
+// receiving after a rekey, so packets already in flight still decrypt
+const RekeyGracePeriod = 30 * time.Second
+
+// Keyring holds the transport sessions of one peer across rekeys.
+//
+// The current session is used for sending. After a rekey the old current
+// session becomes the previous one and is kept for receiving only, for
+// RekeyGracePeriod. A responder that completes a new handshake holds the
+// result as the next session until the initiator proves it has the keys by
+// sending a packet with them; only then does it start sending with it.
+type Keyring struct {
+	mu       sync.RWMutex
+	current  *Session
+	previous *Session
+	next     *Session
+	rotated  time.Time
+}
+
+// Current returns the session used for sending, or nil if there is none
+func (k *Keyring) Current() *Session {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Install makes s the current session immediately
+func (k *Keyring) Install(s *Session) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rotate(s)
+	k.next = nil
+}
+
+// SetNext holds s until the peer confirms it. If there is no current session
+// yet, s is installed directly.
+func (k *Keyring) SetNext(s *Session) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.current == nil {
+		k.rotate(s)
+		return
+	}
+	k.next = s
+}
+
+// Confirm promotes s to the current session if it is the pending next session
+func (k *Keyring) Confirm(s *Session) {
+	k.mu.RLock()
+	pending := k.next == s
+	k.mu.RUnlock()
+	if !pending {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.next == s {
+		k.rotate(s)
+		k.next = nil
+	}
+}
+
+// Pending reports whether a next session is waiting for confirmation
+func (k *Keyring) Pending() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.next != nil
+}
+
+// Lookup returns the session for a key epoch, or nil if none matches
+func (k *Keyring) Lookup(epoch uint8) *Session {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current != nil && k.current.Epoch == epoch {
+		return k.current
+	}
+	if k.next != nil && k.next.Epoch == epoch {
+		return k.next
+	}
+	if k.previous != nil && k.previous.Epoch == epoch && time.Since(k.rotated) < RekeyGracePeriod {
+		return k.previous
+	}
+	return nil
+}
+
+// rotate moves the current session to previous and installs s
+func (k *Keyring) rotate(s *Session) {
+	if k.current != nil {
+		k.previous = k.current
+		k.rotated = time.Now()
+	}
+	k.current = s
+}
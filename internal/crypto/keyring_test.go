@@ -0,0 +1,151 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testSession returns a session for a key epoch
+func testSession(t *testing.T, epoch uint8) *Session {
+	t.Helper()
+
+	suite, _ := SuiteByID(SuiteAES256GCM)
+	s, err := NewSession(&SessionKeys{Send: make([]byte, KeySize), Receive: make([]byte, KeySize)}, epoch, suite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeyringSetNextWithoutCurrent(t *testing.T) {
+	var k Keyring
+	s := testSession(t, 1)
+
+	k.SetNext(s)
+	if k.Current() != s {
+		t.Fatal("first session not installed directly")
+	}
+	if k.Pending() {
+		t.Fatal("first session left pending")
+	}
+	if k.Lookup(1) != s {
+		t.Fatal("first session not found by its epoch")
+	}
+}
+
+func TestKeyringEpochSwitch(t *testing.T) {
+	var k Keyring
+	old, next := testSession(t, 1), testSession(t, 2)
+	k.Install(old)
+
+	k.SetNext(next)
+	if k.Current() != old {
+		t.Fatal("unconfirmed session used for sending")
+	}
+	if !k.Pending() {
+		t.Fatal("next session not pending")
+	}
+	if k.Lookup(1) != old || k.Lookup(2) != next {
+		t.Fatal("sessions not found by their epochs while the next one is pending")
+	}
+
+	// Only the pending session can be confirmed
+	k.Confirm(testSession(t, 2))
+	if k.Current() != old || !k.Pending() {
+		t.Fatal("confirming another session switched epochs")
+	}
+
+	k.Confirm(next)
+	if k.Current() != next {
+		t.Fatal("confirmed session not used for sending")
+	}
+	if k.Pending() {
+		t.Fatal("confirmed session still pending")
+	}
+	if k.Lookup(2) != next {
+		t.Fatal("new epoch not found")
+	}
+	if k.Lookup(1) != old {
+		t.Fatal("old epoch not kept for receiving")
+	}
+	if k.Lookup(3) != nil {
+		t.Fatal("unknown epoch found")
+	}
+
+	// Confirming again, as every packet under the new keys does, is a no-op
+	k.Confirm(next)
+	if k.Current() != next || k.Lookup(1) != old {
+		t.Fatal("repeated confirm rotated the keyring")
+	}
+}
+
+func TestKeyringInstall(t *testing.T) {
+	var k Keyring
+	old, next, installed := testSession(t, 1), testSession(t, 2), testSession(t, 3)
+	k.Install(old)
+	k.SetNext(next)
+
+	k.Install(installed)
+	if k.Current() != installed {
+		t.Fatal("installed session not used for sending")
+	}
+	if k.Pending() || k.Lookup(2) != nil {
+		t.Fatal("install kept the pending session")
+	}
+	if k.Lookup(1) != old {
+		t.Fatal("old epoch not kept for receiving")
+	}
+
+	// A late confirmation of the dropped session changes nothing
+	k.Confirm(next)
+	if k.Current() != installed {
+		t.Fatal("dropped session confirmed")
+	}
+}
+
+func TestKeyringGracePeriod(t *testing.T) {
+	var k Keyring
+	old, next := testSession(t, 1), testSession(t, 2)
+	k.Install(old)
+	k.Install(next)
+
+	k.mu.Lock()
+	k.rotated = time.Now().Add(-RekeyGracePeriod + time.Second)
+	k.mu.Unlock()
+	if k.Lookup(1) != old {
+		t.Fatal("old epoch dropped within the grace period")
+	}
+
+	k.mu.Lock()
+	k.rotated = time.Now().Add(-RekeyGracePeriod)
+	k.mu.Unlock()
+	if k.Lookup(1) != nil {
+		t.Fatal("old epoch accepted after the grace period")
+	}
+	if k.Lookup(2) != next {
+		t.Fatal("current epoch dropped with the old one")
+	}
+}
+
+func TestKeyringRejectAfterTime(t *testing.T) {
+	var k Keyring
+	s := testSession(t, 1)
+	k.Install(s)
+
+	s.created = time.Now().Add(-RejectAfterTime + time.Second)
+	if _, err := k.Current().NextCounter(); err != nil {
+		t.Fatalf("session refused to send before RejectAfterTime: %v", err)
+	}
+
+	s.created = time.Now().Add(-RejectAfterTime)
+	if _, err := k.Current().NextCounter(); !errors.Is(err, ErrKeyExpired) {
+		t.Fatalf("session past RejectAfterTime: got %v, want %v", err, ErrKeyExpired)
+	}
+
+	// A rekey makes the keyring usable for sending again
+	k.Install(testSession(t, 2))
+	if _, err := k.Current().NextCounter(); err != nil {
+		t.Fatalf("new session refused to send: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// PrivateKey is a Curve25519 static private key
+type PrivateKey [KeySize]byte
+
+// PublicKey is a Curve25519 static public key
+type PublicKey [PublicKeySize]byte
+
+// PresharedKey is an optional symmetric key shared by a client and the server
+type PresharedKey [KeySize]byte
+
+// GeneratePrivateKey generates a new random static private key
+func GeneratePrivateKey() (PrivateKey, error) {
+	var key PrivateKey
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+// PublicKey returns the public key for the private key
+func (k PrivateKey) PublicKey() PublicKey {
+	var pub PublicKey
+	private, err := ecdh.X25519().NewPrivateKey(k[:])
+	if err != nil {
+		// X25519 accepts any 32-byte scalar
+		panic(err)
+	}
+	copy(pub[:], private.PublicKey().Bytes())
+	return pub
+}
+
+// GeneratePresharedKey generates a new random pre-shared key
+func GeneratePresharedKey() (PresharedKey, error) {
+	var key PresharedKey
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, err
+	}
+	return key, nil
+}
+
+// String returns the base64 encoding of the private key
+func (k PrivateKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// String returns the base64 encoding of the public key
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// String returns the base64 encoding of the pre-shared key
+func (k PresharedKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParsePrivateKey parses a base64-encoded private key
+func ParsePrivateKey(s string) (PrivateKey, error) {
+	var key PrivateKey
+	err := parseKey(s, key[:])
+	return key, err
+}
+
+// ParsePublicKey parses a base64-encoded public key
+func ParsePublicKey(s string) (PublicKey, error) {
+	var key PublicKey
+	err := parseKey(s, key[:])
+	return key, err
+}
+
+// ParsePresharedKey parses a base64-encoded pre-shared key
+func ParsePresharedKey(s string) (PresharedKey, error) {
+	var key PresharedKey
+	err := parseKey(s, key[:])
+	return key, err
+}
+
+func parseKey(s string, dst []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid key encoding: %w", err)
+	}
+	if len(raw) != len(dst) {
+		return fmt.Errorf("invalid key size: %d bytes", len(raw))
+	}
+	copy(dst, raw)
+	return nil
+}
+
+// LoadPrivateKey reads a base64-encoded private key from a file
+func LoadPrivateKey(path string) (PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	return ParsePrivateKey(string(data))
+}
+
+// LoadPresharedKey reads a base64-encoded pre-shared key from a file
+func LoadPresharedKey(path string) (PresharedKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PresharedKey{}, err
+	}
+	return ParsePresharedKey(string(data))
+}
+
+// LoadPresharedKeys reads per-client pre-shared keys from a file, one
+// "<client public key> <pre-shared key>" pair per line. Blank lines and
+// lines starting with '#' are ignored.
+func LoadPresharedKeys(path string) (map[PublicKey]PresharedKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[PublicKey]PresharedKey)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a public key and a pre-shared key", path, lineNum)
+		}
+		peer, err := ParsePublicKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		psk, err := ParsePresharedKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		keys[peer] = psk
+	}
+
+	return keys, scanner.Err()
+}
+
+// LoadPublicKeys reads base64-encoded public keys from a file, one per line.
+// Blank lines and lines starting with '#' are ignored.
+func LoadPublicKeys(path string) ([]PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var keys []PublicKey
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := ParsePublicKey(strings.Fields(line)[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, scanner.Err()
+}
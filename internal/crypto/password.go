@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// passwordSaltSize is the size of the random salt in a password hash
+	passwordSaltSize = 16
+	// passwordHashSize is the size of the derived Argon2id output
+	passwordHashSize = 32
+)
+
+// PasswordParams are the Argon2id cost parameters for hashing a password
+type PasswordParams struct {
+	Memory  uint32 // Memory in KiB
+	Time    uint32 // Number of passes over the memory
+	Threads uint8  // Degree of parallelism
+}
+
+// DefaultPasswordParams follow the RFC 9106 recommendation for
+// memory-constrained environments: 64 MiB, 3 passes, 4 lanes
+var DefaultPasswordParams = PasswordParams{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 4,
+}
+
+// ErrInvalidPasswordHash is returned for password hashes that are not
+// well-formed PHC strings for Argon2id
+var ErrInvalidPasswordHash = errors.New("invalid password hash")
+
+// HashPassword hashes a password with Argon2id and a random salt and returns
+// it in PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func HashPassword(password string, params PasswordParams) (string, error) {
+	if params.Memory < 8*uint32(params.Threads) || params.Time < 1 || params.Threads < 1 {
+		return "", errors.New("invalid Argon2id parameters")
+	}
+
+	salt := make([]byte, passwordSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, passwordHashSize)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// VerifyPassword reports whether password matches a PHC-encoded Argon2id hash.
+// The cost parameters are taken from the hash, so hashes made with different
+// parameters keep working when the defaults change.
+func VerifyPassword(password, encoded string) (bool, error) {
+	params, salt, hash, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, other) == 1, nil
+}
+
+// ValidatePasswordHash checks that encoded is a well-formed Argon2id hash
+// without doing the work of verifying a password against it
+func ValidatePasswordHash(encoded string) error {
+	_, _, _, err := decodePasswordHash(encoded)
+	return err
+}
+
+// decodePasswordHash parses a PHC-encoded Argon2id hash
+func decodePasswordHash(encoded string) (PasswordParams, []byte, []byte, error) {
+	var params PasswordParams
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: unsupported version", ErrInvalidPasswordHash)
+	}
+
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("%w: bad parameters", ErrInvalidPasswordHash)
+	}
+	if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+		return params, nil, nil, fmt.Errorf("%w: bad parameters", ErrInvalidPasswordHash)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: bad salt", ErrInvalidPasswordHash)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(hash) < 16 {
+		return params, nil, nil, fmt.Errorf("%w: bad hash", ErrInvalidPasswordHash)
+	}
+
+	return params, salt, hash, nil
+}
+
+// LoadPasswordHashes reads "user:hash" lines from a file, where hash is a
+// PHC-encoded Argon2id hash. Blank lines and lines starting with '#' are ignored.
+func LoadPasswordHashes(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNum)
+		}
+		if err := ValidatePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		if _, dup := hashes[user]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, lineNum, user)
+		}
+		hashes[user] = hash
+	}
+
+	return hashes, scanner.Err()
+}
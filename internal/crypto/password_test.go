@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testPasswordParams keep the tests fast; the format is the same
+var testPasswordParams = PasswordParams{Memory: 64, Time: 1, Threads: 1}
+
+func TestHashPassword(t *testing.T) {
+	encoded, err := HashPassword("secret", testPasswordParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected encoding %q", encoded)
+	}
+
+	ok, err := VerifyPassword("secret", encoded)
+	if err != nil || !ok {
+		t.Fatalf("correct password: got %v, %v", ok, err)
+	}
+	ok, err = VerifyPassword("wrong", encoded)
+	if err != nil || ok {
+		t.Fatalf("wrong password: got %v, %v", ok, err)
+	}
+
+	other, err := HashPassword("secret", testPasswordParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == encoded {
+		t.Fatal("two hashes of a password share a salt")
+	}
+}
+
+func TestVerifyPasswordKnownHash(t *testing.T) {
+	// From the test vectors of the reference Argon2 implementation
+	const encoded = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+
+	params, salt, hash, err := decodePasswordHash(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != (PasswordParams{Memory: 65536, Time: 2, Threads: 1}) {
+		t.Fatalf("parameters: got %+v", params)
+	}
+	if string(salt) != "somesalt" || len(hash) != 32 {
+		t.Fatalf("salt %q, hash of %d bytes", salt, len(hash))
+	}
+
+	ok, err := VerifyPassword("password", encoded)
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+}
+
+func TestDecodePasswordHashInvalid(t *testing.T) {
+	const salt, hash = "c29tZXNhbHQ", "CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"bcrypt", "$2b$10$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234"},
+		{"argon2i", "$argon2i$v=19$m=64,t=2,p=1$" + salt + "$" + hash},
+		{"missing field", "$argon2id$v=19$m=64,t=2,p=1$" + hash},
+		{"old version", "$argon2id$v=16$m=64,t=2,p=1$" + salt + "$" + hash},
+		{"bad parameters", "$argon2id$v=19$m=64;t=2;p=1$" + salt + "$" + hash},
+		{"zero passes", "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + hash},
+		{"too little memory", "$argon2id$v=19$m=7,t=2,p=1$" + salt + "$" + hash},
+		{"bad salt", "$argon2id$v=19$m=64,t=2,p=1$not*base64$" + hash},
+		{"short hash", "$argon2id$v=19$m=64,t=2,p=1$" + salt + "$c2hvcnQ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePasswordHash(tt.encoded); !errors.Is(err, ErrInvalidPasswordHash) {
+				t.Fatalf("got %v, want ErrInvalidPasswordHash", err)
+			}
+		})
+	}
+}
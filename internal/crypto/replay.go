@@ -0,0 +1,73 @@
+package crypto
+
+import "sync"
+
+const (
+	// ReplayWindowSize is the number of packet counters tracked behind the
+	// highest counter received
+	ReplayWindowSize = 2048
+
+	replayBlockBits = 64
+	replayBlocks    = ReplayWindowSize / replayBlockBits
+	replayBlockMask = replayBlocks - 1
+)
+
+// ReplayWindow is a sliding bitmap of received packet counters (RFC 6479).
+//
+// Counters newer than the highest one seen slide the window forward;
+// counters within the window are accepted once; anything older is rejected.
+type ReplayWindow struct {
+	mu      sync.Mutex
+	highest uint64
+	started bool
+	bitmap  [replayBlocks]uint64
+}
+
+// Check reports whether counter would be accepted, without recording it.
+// It lets callers drop replays before spending time on decryption.
+func (w *ReplayWindow) Check(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.check(counter)
+}
+
+// Accept records counter as received and reports whether it was new
+func (w *ReplayWindow) Accept(counter uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.check(counter) {
+		return false
+	}
+
+	block := counter / replayBlockBits
+	if !w.started || counter > w.highest {
+		if w.started {
+			// Clear the blocks the window slides over
+			current := w.highest / replayBlockBits
+			diff := block - current
+			if diff > replayBlocks {
+				diff = replayBlocks
+			}
+			for i := uint64(1); i <= diff; i++ {
+				w.bitmap[(current+i)&replayBlockMask] = 0
+			}
+		}
+		w.highest = counter
+		w.started = true
+	}
+
+	w.bitmap[block&replayBlockMask] |= 1 << (counter % replayBlockBits)
+	return true
+}
+
+func (w *ReplayWindow) check(counter uint64) bool {
+	if !w.started || counter > w.highest {
+		return true
+	}
+	if w.highest-counter >= ReplayWindowSize-replayBlockBits {
+		return false
+	}
+	block := counter / replayBlockBits
+	return w.bitmap[block&replayBlockMask]&(1<<(counter%replayBlockBits)) == 0
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import "testing"
+
+func TestReplayWindowRejectsDuplicates(t *testing.T) {
+	var w ReplayWindow
+
+	for _, counter := range []uint64{0, 1, 5, 3, 2, 4} {
+		if !w.Accept(counter) {
+			t.Fatalf("counter %d rejected the first time", counter)
+		}
+	}
+	for _, counter := range []uint64{0, 1, 2, 3, 4, 5} {
+		if w.Accept(counter) {
+			t.Fatalf("counter %d accepted twice", counter)
+		}
+	}
+}
+
+func TestReplayWindowCheckDoesNotRecord(t *testing.T) {
+	var w ReplayWindow
+
+	if !w.Check(7) || !w.Check(7) {
+		t.Fatal("Check rejected a new counter")
+	}
+	if !w.Accept(7) {
+		t.Fatal("counter rejected after Check")
+	}
+	if w.Check(7) {
+		t.Fatal("Check accepted a recorded counter")
+	}
+}
+
+func TestReplayWindowEdge(t *testing.T) {
+	var w ReplayWindow
+	const highest = 10000
+
+	if !w.Accept(highest) {
+		t.Fatal("highest counter rejected")
+	}
+
+	// The window tracks ReplayWindowSize counters less one block, since
+	// the block holding the highest counter is only partly used
+	oldest := uint64(highest - (ReplayWindowSize - replayBlockBits - 1))
+	if !w.Accept(oldest) {
+		t.Fatalf("counter %d at the back edge of the window rejected", oldest)
+	}
+	if w.Check(oldest - 1) {
+		t.Fatalf("counter %d behind the window accepted", oldest-1)
+	}
+	if w.Check(0) {
+		t.Fatal("counter 0 accepted far behind the window")
+	}
+}
+
+func TestReplayWindowSlide(t *testing.T) {
+	var w ReplayWindow
+
+	for counter := uint64(0); counter < replayBlockBits; counter++ {
+		w.Accept(counter)
+	}
+
+	// Slide a full window ahead: the blocks that now cover new counters
+	// must be cleared of the old ones sharing their bitmap slots
+	highest := uint64(ReplayWindowSize + 100)
+	if !w.Accept(highest) {
+		t.Fatal("counter ahead of the window rejected")
+	}
+	reused := uint64(ReplayWindowSize + 5) // Same slot and bit as counter 5
+	if !w.Accept(reused) {
+		t.Fatalf("counter %d rejected after the window slid over its slot", reused)
+	}
+	if w.Check(5) {
+		t.Fatal("counter behind the slid window accepted")
+	}
+
+	// A small step forward keeps the counters already seen
+	if !w.Accept(highest + 1) {
+		t.Fatal("next counter rejected")
+	}
+	if w.Check(reused) || w.Check(highest) {
+		t.Fatal("recorded counter accepted after a small slide")
+	}
+}
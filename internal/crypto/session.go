@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// RekeyAfterMessages is the number of packets after which a new handshake is started
+	RekeyAfterMessages = 1 << 60
+	// RejectAfterMessages is the number of packets after which a key must no
+	// longer be used for sending
+	RejectAfterMessages = 1<<64 - 1<<13 - 1
+	// RekeyAfterTime is the key age after which a new handshake is started
+	RekeyAfterTime = 2 * time.Minute
+	// RejectAfterTime is the key age after which a key must no longer be used for sending
+	RejectAfterTime = 3 * time.Minute
+)
+
+var (
+	// ErrReplay is returned when a packet counter has already been received
+	// or is too old for the replay window
+	ErrReplay = errors.New("replayed packet")
+	// ErrCounterExhausted is returned when the send counter has run out
+	ErrCounterExhausted = errors.New("send counter exhausted")
+	// ErrKeyExpired is returned when a key is too old to send with
+	ErrKeyExpired = errors.New("session key expired")
+)
+
+// Session holds the transport state of one completed handshake: a key per
+// direction, the send counter and the receive replay window
+type Session struct {
+	// Epoch identifies the handshake that produced the keys
+	Epoch uint8
+
+	created     time.Time
+	send        *Crypto
+	recv        *Crypto
+	sendCounter atomic.Uint64
+	replay      ReplayWindow
+}
+
+// NewSession creates a transport session for a key epoch from handshake
+// keys, using the negotiated cipher suite
+func NewSession(keys *SessionKeys, epoch uint8, suite CipherSuite) (*Session, error) {
+	send, err := NewCryptoFromKey(suite, keys.Send)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := NewCryptoFromKey(suite, keys.Receive)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Epoch: epoch, created: time.Now(), send: send, recv: recv}, nil
+}
+
+// NeedsRekey reports whether the session is old enough, by time or by
+// packets sent, that a new handshake should be started
+func (s *Session) NeedsRekey() bool {
+	return time.Since(s.created) >= RekeyAfterTime || s.sendCounter.Load() >= RekeyAfterMessages
+}
+
+// NextCounter reserves the next send counter
+func (s *Session) NextCounter() (uint64, error) {
+	if time.Since(s.created) >= RejectAfterTime {
+		return 0, ErrKeyExpired
+	}
+
+	counter := s.sendCounter.Add(1) - 1
+	if counter >= RejectAfterMessages {
+		return 0, ErrCounterExhausted
+	}
+	return counter, nil
+}
+
+// Encrypt seals plaintext under a counter reserved with NextCounter,
+// authenticating the cleartext packet header passed as ad
+func (s *Session) Encrypt(counter uint64, plaintext, ad []byte) []byte {
+	return s.send.Encrypt(counter, plaintext, ad)
+}
+
+// Check reports whether a packet with counter could be accepted, so replays
+// and too-old packets can be dropped before any decryption is attempted
+func (s *Session) Check(counter uint64) bool {
+	return counter < RejectAfterMessages && s.replay.Check(counter)
+}
+
+// Open decrypts a packet sent with counter and authenticated header ad.
+// Replayed and too-old counters are rejected with ErrReplay.
+func (s *Session) Open(counter uint64, ciphertext, ad []byte) ([]byte, error) {
+	if !s.Check(counter) {
+		return nil, ErrReplay
+	}
+
+	plaintext, err := s.recv.Decrypt(counter, ciphertext, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only authenticated counters may move the window
+	if !s.replay.Accept(counter) {
+		return nil, ErrReplay
+	}
+	return plaintext, nil
+}
+
+// Suite returns the cipher suite protecting the session
+func (s *Session) Suite() CipherSuite {
+	return s.send.Suite()
+}
+
+// Overhead returns the number of bytes encryption adds to a payload
+func (s *Session) Overhead() int {
+	return s.send.Overhead()
+}
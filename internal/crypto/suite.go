@@ -0,0 +1,150 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// SuiteID identifies a cipher suite on the wire
+type SuiteID uint8
+
+const (
+	// SuiteAES256GCM is AES-256 in Galois/Counter Mode
+	SuiteAES256GCM SuiteID = 0x01
+	// SuiteChaCha20Poly1305 is ChaCha20-Poly1305 (RFC 8439)
+	SuiteChaCha20Poly1305 SuiteID = 0x02
+	// SuiteXChaCha20Poly1305 is ChaCha20-Poly1305 with an extended 24-byte nonce
+	SuiteXChaCha20Poly1305 SuiteID = 0x03
+)
+
+// CipherSuite is an AEAD that transport keys can be used with
+type CipherSuite interface {
+	// ID returns the suite's wire identifier
+	ID() SuiteID
+	// Name returns the suite's name as used in configuration
+	Name() string
+	// NewAEAD creates the AEAD for a KeySize-byte key
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+type aesGCMSuite struct{}
+
+func (aesGCMSuite) ID() SuiteID  { return SuiteAES256GCM }
+func (aesGCMSuite) Name() string { return "aes-256-gcm" }
+
+func (aesGCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type chaCha20Poly1305Suite struct{}
+
+func (chaCha20Poly1305Suite) ID() SuiteID  { return SuiteChaCha20Poly1305 }
+func (chaCha20Poly1305Suite) Name() string { return "chacha20-poly1305" }
+
+func (chaCha20Poly1305Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+type xChaCha20Poly1305Suite struct{}
+
+func (xChaCha20Poly1305Suite) ID() SuiteID  { return SuiteXChaCha20Poly1305 }
+func (xChaCha20Poly1305Suite) Name() string { return "xchacha20-poly1305" }
+
+func (xChaCha20Poly1305Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+// suites lists every supported cipher suite
+var suites = []CipherSuite{
+	aesGCMSuite{},
+	chaCha20Poly1305Suite{},
+	xChaCha20Poly1305Suite{},
+}
+
+// SuiteByID returns the cipher suite with the given wire identifier
+func SuiteByID(id SuiteID) (CipherSuite, bool) {
+	for _, suite := range suites {
+		if suite.ID() == id {
+			return suite, true
+		}
+	}
+	return nil, false
+}
+
+// ParseSuites parses a comma-separated list of cipher suite names
+func ParseSuites(names string) ([]CipherSuite, error) {
+	var list []CipherSuite
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		var found CipherSuite
+		for _, suite := range suites {
+			if suite.Name() == name {
+				found = suite
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		list = append(list, found)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no cipher suites given")
+	}
+	return list, nil
+}
+
+// DefaultSuites returns every supported suite in order of preference for
+// this machine: AES-256-GCM first when the CPU has AES instructions,
+// ChaCha20-Poly1305 first otherwise
+func DefaultSuites() []CipherSuite {
+	if hasAESHardware() {
+		return []CipherSuite{aesGCMSuite{}, chaCha20Poly1305Suite{}, xChaCha20Poly1305Suite{}}
+	}
+	return []CipherSuite{chaCha20Poly1305Suite{}, xChaCha20Poly1305Suite{}, aesGCMSuite{}}
+}
+
+// NegotiateSuite picks the first suite in preference order that the peer
+// offered. A peer that offers nothing predates negotiation and only
+// speaks AES-256-GCM.
+func NegotiateSuite(preference []CipherSuite, offered []SuiteID) (CipherSuite, bool) {
+	if len(offered) == 0 {
+		offered = []SuiteID{SuiteAES256GCM}
+	}
+
+	for _, suite := range preference {
+		for _, id := range offered {
+			if suite.ID() == id {
+				return suite, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
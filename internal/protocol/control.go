@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ControlType identifies a control message
+type ControlType uint8
+
+const (
+	// ControlDisconnect ends a session gracefully
+	ControlDisconnect ControlType = 0x01
+	// ControlError ends a session because of an error
+	ControlError ControlType = 0x02
+	// ControlConfig pushes tunnel configuration from the server to the client
+	ControlConfig ControlType = 0x03
+	// ControlConfigRequest asks the server to push the configuration again,
+	// when the push after the handshake was lost
+	ControlConfigRequest ControlType = 0x04
+)
+
+// Control message attributes
+const (
+	// AttrReason is a human-readable explanation
+	AttrReason AttributeType = 0x10
+	// AttrErrorCode is an ErrorCode
+	AttrErrorCode AttributeType = 0x11
+	// AttrTunnelIP is the client's address inside the tunnel
+	AttrTunnelIP AttributeType = 0x12
+	// AttrNetmask is the netmask of the tunnel network
+	AttrNetmask AttributeType = 0x13
+	// AttrRoute is a network to route through the tunnel (repeated)
+	AttrRoute AttributeType = 0x14
+	// AttrDNS is a DNS server to use while connected (repeated)
+	AttrDNS AttributeType = 0x15
+	// AttrMTU is the MTU of the tunnel interface
+	AttrMTU AttributeType = 0x16
+)
+
+// ErrorCode says why a session was ended
+type ErrorCode uint8
+
+const (
+	// ErrorCodeInternal is an unexpected failure on the sender's side
+	ErrorCodeInternal ErrorCode = 0x01
+	// ErrorCodeRevoked means the client's certificate or key was revoked
+	ErrorCodeRevoked ErrorCode = 0x02
+	// ErrorCodeSessionExpired means the session was idle for too long
+	ErrorCodeSessionExpired ErrorCode = 0x03
+	// ErrorCodeSessionReplaced means the client key opened another session
+	ErrorCodeSessionReplaced ErrorCode = 0x04
+	// ErrorCodeNoAddress means the server has no tunnel address to assign
+	ErrorCodeNoAddress ErrorCode = 0x05
+)
+
+// String describes the error code
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeInternal:
+		return "internal error"
+	case ErrorCodeRevoked:
+		return "credentials revoked"
+	case ErrorCodeSessionExpired:
+		return "session expired"
+	case ErrorCodeSessionReplaced:
+		return "session replaced"
+	case ErrorCodeNoAddress:
+		return "no tunnel address available"
+	}
+	return fmt.Sprintf("error %d", uint8(c))
+}
+
+// ControlMessage is a message carried in an encrypted control packet:
+// a ControlType byte followed by type-length-value attributes
+type ControlMessage interface {
+	ControlType() ControlType
+	appendAttributes(buf []byte) []byte
+}
+
+// Disconnect tells the peer that the session is over. Clients send it when
+// they quit and servers when they shut down, so neither side waits for the
+// session to time out.
+type Disconnect struct {
+	Reason string
+}
+
+// SessionError tells the peer that the session was ended because of an error
+type SessionError struct {
+	Code   ErrorCode
+	Reason string // Optional detail
+}
+
+// Error describes the error
+func (e *SessionError) Error() string {
+	if e.Reason == "" {
+		return e.Code.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// ConfigPush carries the tunnel configuration the server assigns to a client
+type ConfigPush struct {
+	TunnelIP net.IP
+	Netmask  net.IPMask
+	Routes   []*net.IPNet
+	DNS      []net.IP
+	MTU      uint16 // 0 if not set
+}
+
+// ConfigRequest asks the server for the client's tunnel configuration
+type ConfigRequest struct{}
+
+// ControlType implements ControlMessage
+func (*Disconnect) ControlType() ControlType { return ControlDisconnect }
+
+// ControlType implements ControlMessage
+func (*SessionError) ControlType() ControlType { return ControlError }
+
+// ControlType implements ControlMessage
+func (*ConfigPush) ControlType() ControlType { return ControlConfig }
+
+// ControlType implements ControlMessage
+func (*ConfigRequest) ControlType() ControlType { return ControlConfigRequest }
+
+func (m *Disconnect) appendAttributes(buf []byte) []byte {
+	if m.Reason != "" {
+		buf = appendAttribute(buf, AttrReason, []byte(m.Reason))
+	}
+	return buf
+}
+
+func (m *SessionError) appendAttributes(buf []byte) []byte {
+	buf = appendAttribute(buf, AttrErrorCode, []byte{byte(m.Code)})
+	if m.Reason != "" {
+		buf = appendAttribute(buf, AttrReason, []byte(m.Reason))
+	}
+	return buf
+}
+
+func (m *ConfigPush) appendAttributes(buf []byte) []byte {
+	if m.TunnelIP != nil {
+		buf = appendAttribute(buf, AttrTunnelIP, ipBytes(m.TunnelIP))
+	}
+	if m.Netmask != nil {
+		buf = appendAttribute(buf, AttrNetmask, m.Netmask)
+	}
+	for _, route := range m.Routes {
+		buf = appendAttribute(buf, AttrRoute, encodeNetwork(route))
+	}
+	for _, dns := range m.DNS {
+		buf = appendAttribute(buf, AttrDNS, ipBytes(dns))
+	}
+	if m.MTU != 0 {
+		buf = appendAttribute(buf, AttrMTU, binary.BigEndian.AppendUint16(nil, m.MTU))
+	}
+	return buf
+}
+
+func (m *ConfigRequest) appendAttributes(buf []byte) []byte {
+	return buf
+}
+
+// EncodeControl encodes a control message
+func EncodeControl(m ControlMessage) []byte {
+	return m.appendAttributes([]byte{byte(m.ControlType())})
+}
+
+// DecodeControl decodes a control message. Unknown attributes are skipped;
+// unknown message types are an error.
+func DecodeControl(data []byte) (ControlMessage, error) {
+	if len(data) < 1 {
+		return nil, errors.New("empty control message")
+	}
+
+	switch ControlType(data[0]) {
+	case ControlDisconnect:
+		m := &Disconnect{}
+		err := walkAttributes(data[1:], func(t AttributeType, value []byte) error {
+			if t == AttrReason {
+				m.Reason = string(value)
+			}
+			return nil
+		})
+		return m, err
+
+	case ControlError:
+		m := &SessionError{}
+		err := walkAttributes(data[1:], func(t AttributeType, value []byte) error {
+			switch t {
+			case AttrErrorCode:
+				if len(value) != 1 {
+					return errors.New("invalid error code attribute")
+				}
+				m.Code = ErrorCode(value[0])
+			case AttrReason:
+				m.Reason = string(value)
+			}
+			return nil
+		})
+		return m, err
+
+	case ControlConfig:
+		m := &ConfigPush{}
+		err := walkAttributes(data[1:], func(t AttributeType, value []byte) error {
+			switch t {
+			case AttrTunnelIP:
+				ip, err := parseIP(value)
+				if err != nil {
+					return err
+				}
+				m.TunnelIP = ip
+			case AttrNetmask:
+				if len(value) != net.IPv4len && len(value) != net.IPv6len {
+					return errors.New("invalid netmask attribute")
+				}
+				m.Netmask = append(net.IPMask(nil), value...)
+			case AttrRoute:
+				route, err := decodeNetwork(value)
+				if err != nil {
+					return err
+				}
+				m.Routes = append(m.Routes, route)
+			case AttrDNS:
+				ip, err := parseIP(value)
+				if err != nil {
+					return err
+				}
+				m.DNS = append(m.DNS, ip)
+			case AttrMTU:
+				if len(value) != 2 {
+					return errors.New("invalid MTU attribute")
+				}
+				m.MTU = binary.BigEndian.Uint16(value)
+			}
+			return nil
+		})
+		return m, err
+
+	case ControlConfigRequest:
+		return &ConfigRequest{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown control message type %d", data[0])
+}
+
+// ipBytes returns the 4-byte form of IPv4 addresses and the 16-byte form of others
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func parseIP(value []byte) (net.IP, error) {
+	if len(value) != net.IPv4len && len(value) != net.IPv6len {
+		return nil, errors.New("invalid IP address attribute")
+	}
+	return append(net.IP(nil), value...), nil
+}
+
+// encodeNetwork encodes a network as its address followed by the prefix length
+func encodeNetwork(network *net.IPNet) []byte {
+	ones, _ := network.Mask.Size()
+	return append(ipBytes(network.IP), byte(ones))
+}
+
+func decodeNetwork(value []byte) (*net.IPNet, error) {
+	if len(value) < 1 {
+		return nil, errors.New("invalid route attribute")
+	}
+	ip, err := parseIP(value[:len(value)-1])
+	if err != nil {
+		return nil, err
+	}
+	ones := int(value[len(value)-1])
+	if ones > len(ip)*8 {
+		return nil, errors.New("invalid route prefix length")
+	}
+	mask := net.CIDRMask(ones, len(ip)*8)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
@@ -0,0 +1,197 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+// testConfigPush returns a configuration push with every attribute set
+func testConfigPush(t *testing.T) *ConfigPush {
+	t.Helper()
+	return &ConfigPush{
+		TunnelIP: net.ParseIP("10.0.0.7"),
+		Netmask:  net.CIDRMask(24, 32),
+		Routes:   []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16"), mustParseCIDR(t, "fd00::/64")},
+		DNS:      []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		MTU:      1420,
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  ControlMessage
+	}{
+		{"disconnect", &Disconnect{}},
+		{"disconnect with reason", &Disconnect{Reason: "server shutting down"}},
+		{"error", &SessionError{Code: ErrorCodeRevoked}},
+		{"error with reason", &SessionError{Code: ErrorCodeSessionReplaced, Reason: "new session from 192.0.2.1"}},
+		{"config request", &ConfigRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := DecodeControl(EncodeControl(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.msg) {
+				t.Fatalf("got %#v, want %#v", decoded, tt.msg)
+			}
+		})
+	}
+}
+
+func TestConfigPushRoundTrip(t *testing.T) {
+	push := testConfigPush(t)
+	data := EncodeControl(push)
+
+	msg, err := DecodeControl(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := msg.(*ConfigPush)
+	if !ok {
+		t.Fatalf("decoded a %T", msg)
+	}
+
+	if !decoded.TunnelIP.Equal(push.TunnelIP) {
+		t.Errorf("tunnel IP: got %v, want %v", decoded.TunnelIP, push.TunnelIP)
+	}
+	if decoded.Netmask.String() != push.Netmask.String() {
+		t.Errorf("netmask: got %v, want %v", decoded.Netmask, push.Netmask)
+	}
+	if len(decoded.Routes) != len(push.Routes) {
+		t.Fatalf("got %d routes, want %d", len(decoded.Routes), len(push.Routes))
+	}
+	for i := range push.Routes {
+		if decoded.Routes[i].String() != push.Routes[i].String() {
+			t.Errorf("route %d: got %v, want %v", i, decoded.Routes[i], push.Routes[i])
+		}
+	}
+	if len(decoded.DNS) != len(push.DNS) {
+		t.Fatalf("got %d DNS servers, want %d", len(decoded.DNS), len(push.DNS))
+	}
+	for i := range push.DNS {
+		if !decoded.DNS[i].Equal(push.DNS[i]) {
+			t.Errorf("DNS server %d: got %v, want %v", i, decoded.DNS[i], push.DNS[i])
+		}
+	}
+	if decoded.MTU != push.MTU {
+		t.Errorf("MTU: got %d, want %d", decoded.MTU, push.MTU)
+	}
+	if !bytes.Equal(EncodeControl(decoded), data) {
+		t.Error("re-encoding the decoded push changed it")
+	}
+}
+
+func TestConfigPushEmpty(t *testing.T) {
+	msg, err := DecodeControl(EncodeControl(&ConfigPush{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := msg.(*ConfigPush)
+	if push.TunnelIP != nil || push.Netmask != nil || push.Routes != nil || push.DNS != nil || push.MTU != 0 {
+		t.Fatalf("empty push decoded as %+v", push)
+	}
+}
+
+func TestDecodeControlTruncated(t *testing.T) {
+	messages := []ControlMessage{
+		&Disconnect{Reason: "bye"},
+		&SessionError{Code: ErrorCodeInternal, Reason: "oops"},
+		testConfigPush(t),
+	}
+	for _, m := range messages {
+		data := EncodeControl(m)
+		for _, n := range []int{2, 3, len(data) - 1} {
+			if _, err := DecodeControl(data[:n]); err == nil {
+				t.Errorf("%T truncated to %d of %d bytes decoded", m, n, len(data))
+			}
+		}
+	}
+
+	if _, err := DecodeControl(nil); err == nil {
+		t.Error("empty control message decoded")
+	}
+}
+
+func TestDecodeControlMalformed(t *testing.T) {
+	attr := func(ct ControlType, at AttributeType, value ...byte) []byte {
+		return appendAttribute([]byte{byte(ct)}, at, value)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unknown type", []byte{0xff}},
+		{"long error code", attr(ControlError, AttrErrorCode, 1, 2)},
+		{"empty error code", attr(ControlError, AttrErrorCode)},
+		{"short tunnel IP", attr(ControlConfig, AttrTunnelIP, 10, 0, 0)},
+		{"short netmask", attr(ControlConfig, AttrNetmask, 255, 255, 255)},
+		{"short DNS server", attr(ControlConfig, AttrDNS, 10, 0, 0, 0, 1)},
+		{"empty route", attr(ControlConfig, AttrRoute)},
+		{"short route", attr(ControlConfig, AttrRoute, 10, 0, 8)},
+		{"IPv4 route prefix too long", attr(ControlConfig, AttrRoute, 10, 0, 0, 0, 33)},
+		{"short MTU", attr(ControlConfig, AttrMTU, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeControl(tt.data); err == nil {
+				t.Fatal("malformed control message decoded")
+			}
+		})
+	}
+}
+
+func TestDecodeControlSkipsUnknownAttributes(t *testing.T) {
+	data := EncodeControl(&Disconnect{Reason: "bye"})
+	data = appendAttribute(data, 0x7f, []byte("from a newer peer"))
+
+	msg, err := DecodeControl(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := msg.(*Disconnect); d.Reason != "bye" {
+		t.Fatalf("reason: got %q", d.Reason)
+	}
+}
+
+func TestDecodeNetwork(t *testing.T) {
+	tests := []struct {
+		value []byte
+		want  string
+	}{
+		{[]byte{10, 1, 2, 3, 16}, "10.1.0.0/16"}, // Host bits are cleared
+		{[]byte{0, 0, 0, 0, 0}, "0.0.0.0/0"},
+		{[]byte{192, 0, 2, 1, 32}, "192.0.2.1/32"},
+		{append(net.ParseIP("fd00::1").To16(), 64), "fd00::/64"},
+	}
+	for _, tt := range tests {
+		network, err := decodeNetwork(tt.value)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.value, err)
+		}
+		if network.String() != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.value, network, tt.want)
+		}
+		if !bytes.Equal(encodeNetwork(network), append(ipBytes(network.IP), tt.value[len(tt.value)-1])) {
+			t.Errorf("%v: encoding does not round-trip", tt.value)
+		}
+	}
+
+	if _, err := decodeNetwork(append(net.ParseIP("fd00::").To16(), 129)); err == nil {
+		t.Error("IPv6 prefix longer than 128 bits decoded")
+	}
+}
@@ -0,0 +1,289 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AttributeType identifies a field in an encrypted handshake payload
+type AttributeType uint8
+
+const (
+	// AttrTimestamp is the client's handshake timestamp (unix nanoseconds)
+	AttrTimestamp AttributeType = 0x01
+	// AttrCipherSuites is the client's list of offered cipher suite IDs
+	AttrCipherSuites AttributeType = 0x02
+	// AttrCipherSuite is the cipher suite ID chosen by the server
+	AttrCipherSuite AttributeType = 0x03
+	// AttrUsername is the user name for password authentication
+	AttrUsername AttributeType = 0x04
+	// AttrPassword is the password for password authentication
+	AttrPassword AttributeType = 0x05
+	// AttrKEMPublicKey is the client's ML-KEM-768 encapsulation key,
+	// offering a hybrid key exchange
+	AttrKEMPublicKey AttributeType = 0x06
+	// AttrKEMCiphertext is the server's ML-KEM-768 ciphertext, accepting it
+	AttrKEMCiphertext AttributeType = 0x07
+	// AttrCertificate is the client's CA-signed certificate
+	AttrCertificate AttributeType = 0x08
+	// AttrOTP is a one-time code for users with a second factor
+	AttrOTP AttributeType = 0x09
+	// AttrAuthError is the server's reason for refusing a session after
+	// completing the handshake (see AuthError)
+	AttrAuthError AttributeType = 0x0A
+	// AttrCapabilities is the server's capability bitmap (see Capabilities)
+	AttrCapabilities AttributeType = 0x0B
+	// AttrRekeyProof proves that a rekey or reconnect comes from the
+	// holder of a session's keys (see RekeyProof)
+	AttrRekeyProof AttributeType = 0x0C
+)
+
+// AuthError tells a client why the server refused to open a session. It is
+// carried in an authenticated handshake response so that the client can
+// tell a wrong code from a lost packet.
+type AuthError uint8
+
+const (
+	// AuthErrorOTPRequired asks the client to retry with a one-time code
+	AuthErrorOTPRequired AuthError = 0x01
+	// AuthErrorOTPInvalid reports a wrong, expired or reused one-time code
+	AuthErrorOTPInvalid AuthError = 0x02
+)
+
+// String describes the error
+func (e AuthError) String() string {
+	switch e {
+	case AuthErrorOTPRequired:
+		return "one-time code required"
+	case AuthErrorOTPInvalid:
+		return "invalid one-time code"
+	}
+	return fmt.Sprintf("authentication error %d", uint8(e))
+}
+
+// InitPayload is the encrypted payload carried in a handshake init.
+//
+// Payloads are encoded as a sequence of type-length-value attributes so
+// that fields can be added without breaking older peers; unknown
+// attributes are skipped when decoding.
+type InitPayload struct {
+	// Timestamp must increase with every handshake from the same client key,
+	// which lets the server reject replayed init messages
+	Timestamp uint64
+	// CipherSuites lists the transport cipher suites the client supports,
+	// in the client's order of preference
+	CipherSuites []uint8
+	// Username and Password authenticate the client by password. They are
+	// only ever sent inside the encrypted handshake payload.
+	Username string
+	Password string
+	// KEMPublicKey is set when the client offers a hybrid key exchange. Its
+	// 1184 bytes take the init past a 1280-byte path MTU, and past 1500
+	// bytes together with a certificate, so such inits are IP fragmented.
+	KEMPublicKey []byte
+	// Certificate is the client's encoded certificate, if it has one
+	Certificate []byte
+	// OTP is a one-time code, sent when opening a session for a user
+	// with a second factor
+	OTP string
+	// RekeyProof is sent with inits that rekey an established session or
+	// replace one after a reconnect
+	RekeyProof *RekeyProof
+}
+
+// Encode encodes the init payload into bytes
+func (p *InitPayload) Encode() []byte {
+	var buf []byte
+	buf = appendUint64Attribute(buf, AttrTimestamp, p.Timestamp)
+	if len(p.CipherSuites) > 0 {
+		buf = appendAttribute(buf, AttrCipherSuites, p.CipherSuites)
+	}
+	if p.Username != "" {
+		buf = appendAttribute(buf, AttrUsername, []byte(p.Username))
+		buf = appendAttribute(buf, AttrPassword, []byte(p.Password))
+	}
+	if len(p.KEMPublicKey) > 0 {
+		buf = appendAttribute(buf, AttrKEMPublicKey, p.KEMPublicKey)
+	}
+	if len(p.Certificate) > 0 {
+		buf = appendAttribute(buf, AttrCertificate, p.Certificate)
+	}
+	if p.OTP != "" {
+		buf = appendAttribute(buf, AttrOTP, []byte(p.OTP))
+	}
+	if p.RekeyProof != nil {
+		buf = appendAttribute(buf, AttrRekeyProof, p.RekeyProof.encode())
+	}
+	return buf
+}
+
+// DecodeInitPayload decodes an init payload
+func DecodeInitPayload(data []byte) (*InitPayload, error) {
+	p := &InitPayload{}
+	err := walkAttributes(data, func(t AttributeType, value []byte) error {
+		switch t {
+		case AttrTimestamp:
+			if len(value) != 8 {
+				return errors.New("invalid timestamp attribute")
+			}
+			p.Timestamp = binary.BigEndian.Uint64(value)
+		case AttrCipherSuites:
+			p.CipherSuites = append([]uint8(nil), value...)
+		case AttrUsername:
+			p.Username = string(value)
+		case AttrPassword:
+			p.Password = string(value)
+		case AttrKEMPublicKey:
+			p.KEMPublicKey = append([]byte(nil), value...)
+		case AttrCertificate:
+			p.Certificate = append([]byte(nil), value...)
+		case AttrOTP:
+			p.OTP = string(value)
+		case AttrRekeyProof:
+			if len(value) < rekeyProofHeaderSize {
+				return errors.New("invalid rekey proof attribute")
+			}
+			p.RekeyProof = &RekeyProof{
+				SessionID: binary.BigEndian.Uint32(value[0:4]),
+				KeyEpoch:  value[4],
+				Counter:   binary.BigEndian.Uint64(value[5:rekeyProofHeaderSize]),
+				Tag:       append([]byte(nil), value[rekeyProofHeaderSize:]...),
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RekeyProof is an empty message sealed under the transport keys of an
+// established session, like a transport packet with its own counter: the
+// session being rekeyed, or after a reconnect the one the client had
+// before. The static key alone opens new sessions but cannot produce it, so
+// it lets the server tell the client that opened a session with a one-time
+// code from an attempt to take the session over.
+type RekeyProof struct {
+	SessionID uint32 // Session whose keys sealed the proof
+	KeyEpoch  uint8  // Epoch of those keys
+	Counter   uint64 // Send counter of those keys
+	Tag       []byte
+}
+
+// rekeyProofHeaderSize is the size of the session ID, epoch and counter
+// before the tag
+const rekeyProofHeaderSize = 13
+
+func (p *RekeyProof) encode() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, p.SessionID)
+	buf = append(buf, p.KeyEpoch)
+	buf = binary.BigEndian.AppendUint64(buf, p.Counter)
+	return append(buf, p.Tag...)
+}
+
+// RekeyProofAD returns the associated data a rekey proof authenticates: the
+// session and epoch being negotiated and the init's ephemeral key, which
+// binds the proof to a single handshake. Its length differs from that of a
+// packet header, so no transport packet can pass for a proof.
+func RekeyProofAD(sessionID uint32, epoch uint8, ephemeral []byte) []byte {
+	ad := []byte("omail rekey")
+	ad = binary.BigEndian.AppendUint32(ad, sessionID)
+	ad = append(ad, epoch)
+	return append(ad, ephemeral...)
+}
+
+// ResponsePayload is the encrypted payload carried in a handshake response
+type ResponsePayload struct {
+	// CipherSuite is the transport cipher suite the server chose
+	CipherSuite uint8
+	// KEMCiphertext is set when the server accepted a hybrid key exchange
+	KEMCiphertext []byte
+	// AuthError is set when the server refused the session; no keys are
+	// derived from such a response
+	AuthError AuthError
+	// Capabilities are the features the server supports; the session uses
+	// those both sides support
+	Capabilities Capabilities
+}
+
+// Encode encodes the response payload into bytes
+func (p *ResponsePayload) Encode() []byte {
+	var buf []byte
+	if p.CipherSuite != 0 {
+		buf = appendAttribute(buf, AttrCipherSuite, []byte{p.CipherSuite})
+	}
+	if len(p.KEMCiphertext) > 0 {
+		buf = appendAttribute(buf, AttrKEMCiphertext, p.KEMCiphertext)
+	}
+	if p.AuthError != 0 {
+		buf = appendAttribute(buf, AttrAuthError, []byte{byte(p.AuthError)})
+	}
+	if p.Capabilities != 0 {
+		buf = appendAttribute(buf, AttrCapabilities, binary.BigEndian.AppendUint32(nil, uint32(p.Capabilities)))
+	}
+	return buf
+}
+
+// DecodeResponsePayload decodes a response payload
+func DecodeResponsePayload(data []byte) (*ResponsePayload, error) {
+	p := &ResponsePayload{}
+	err := walkAttributes(data, func(t AttributeType, value []byte) error {
+		switch t {
+		case AttrCipherSuite:
+			if len(value) != 1 {
+				return errors.New("invalid cipher suite attribute")
+			}
+			p.CipherSuite = value[0]
+		case AttrKEMCiphertext:
+			p.KEMCiphertext = append([]byte(nil), value...)
+		case AttrAuthError:
+			if len(value) != 1 {
+				return errors.New("invalid auth error attribute")
+			}
+			p.AuthError = AuthError(value[0])
+		case AttrCapabilities:
+			if len(value) != 4 {
+				return errors.New("invalid capabilities attribute")
+			}
+			p.Capabilities = Capabilities(binary.BigEndian.Uint32(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// appendAttribute appends a type-length-value attribute to buf
+func appendAttribute(buf []byte, t AttributeType, value []byte) []byte {
+	buf = append(buf, byte(t))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// appendUint64Attribute appends a big-endian uint64 attribute to buf
+func appendUint64Attribute(buf []byte, t AttributeType, v uint64) []byte {
+	return appendAttribute(buf, t, binary.BigEndian.AppendUint64(nil, v))
+}
+
+// walkAttributes calls fn for each attribute in data
+func walkAttributes(data []byte, fn func(t AttributeType, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("truncated attribute header")
+		}
+		t := AttributeType(data[0])
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return errors.New("truncated attribute value")
+		}
+		if err := fn(t, data[3:3+length]); err != nil {
+			return err
+		}
+		data = data[3+length:]
+	}
+	return nil
+}
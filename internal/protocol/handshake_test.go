@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+func TestInitPayloadRekeyProof(t *testing.T) {
+	proof := &RekeyProof{SessionID: 0x01020304, KeyEpoch: 7, Counter: 1 << 40, Tag: bytes.Repeat([]byte{0xaa}, 16)}
+	payload := &InitPayload{Timestamp: 42, RekeyProof: proof}
+
+	decoded, err := DecodeInitPayload(payload.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decoded.RekeyProof
+	if got == nil {
+		t.Fatal("rekey proof lost")
+	}
+	if got.SessionID != proof.SessionID || got.KeyEpoch != proof.KeyEpoch || got.Counter != proof.Counter || !bytes.Equal(got.Tag, proof.Tag) {
+		t.Fatalf("got %+v, want %+v", got, proof)
+	}
+
+	decoded, err = DecodeInitPayload((&InitPayload{Timestamp: 42}).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.RekeyProof != nil {
+		t.Fatal("rekey proof decoded from a payload without one")
+	}
+}
+
+func TestRekeyProofADBindsHandshake(t *testing.T) {
+	ephemeral := bytes.Repeat([]byte{1}, 32)
+	ad := RekeyProofAD(1, 2, ephemeral)
+
+	for _, other := range [][]byte{
+		RekeyProofAD(3, 2, ephemeral),
+		RekeyProofAD(1, 3, ephemeral),
+		RekeyProofAD(1, 2, bytes.Repeat([]byte{2}, 32)),
+	} {
+		if bytes.Equal(ad, other) {
+			t.Fatal("proofs for different handshakes share associated data")
+		}
+	}
+}
+
+func TestHybridInitSize(t *testing.T) {
+	clientKey, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := crypto.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := Hello{Version: Version}.Encode()
+	hs, err := crypto.NewInitiator(clientKey, serverKey.PublicKey(), hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := &InitPayload{
+		Timestamp:    1,
+		CipherSuites: []uint8{1, 2},
+		RekeyProof:   &RekeyProof{Tag: make([]byte, 16)},
+	}
+	if payload.KEMPublicKey, err = hs.GenerateKEMKey(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := hs.CreateInit(payload.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := crypto.NewCookieGenerator(serverKey.PublicKey()).AddMACs(append(hello, msg...))
+	pkt := NewHandshakeInitPacket(1, 0, init).Encode()
+
+	// The README gives the init as about 1.38 KB of UDP payload; keep it
+	// in line if the payload grows
+	if len(pkt) > 1400 {
+		t.Fatalf("hybrid init is %d bytes, more than documented", len(pkt))
+	}
+	if len(pkt) <= 1280 {
+		t.Fatalf("hybrid init is %d bytes, less than documented", len(pkt))
+	}
+}
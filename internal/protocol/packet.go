@@ -8,7 +8,7 @@ import (
 
 const (
 	// PacketHeaderSize is the size of the packet header
-	PacketHeaderSize = 8
+	PacketHeaderSize = 16
 	// MaxPacketSize is the maximum packet size (including header)
 	MaxPacketSize = 65535
 )
@@ -21,14 +21,39 @@ const (
 	PacketTypeData PacketType = 0x01
 	// PacketTypeKeepAlive is a keep-alive packet
 	PacketTypeKeepAlive PacketType = 0x02
+	// PacketTypeHandshakeInit is the client's first handshake message
+	PacketTypeHandshakeInit PacketType = 0x03
+	// PacketTypeHandshakeResponse is the server's handshake reply
+	PacketTypeHandshakeResponse PacketType = 0x04
+	// PacketTypeRekey asks the client to start a new handshake
+	PacketTypeRekey PacketType = 0x05
+	// PacketTypeCookieReply answers a handshake init with a cookie when the
+	// server is under load
+	PacketTypeCookieReply PacketType = 0x06
+	// PacketTypeReject refuses a handshake init from an incompatible
+	// client, in the clear (see Reject)
+	PacketTypeReject PacketType = 0x07
+	// PacketTypeControl carries an encrypted control message (see
+	// ControlMessage)
+	PacketTypeControl PacketType = 0x08
+	// PacketTypePing probes a server endpoint before connecting, in the
+	// clear: a nonce followed by mac1 and an empty mac2, so that only
+	// clients that know the server's key get an answer
+	PacketTypePing PacketType = 0x09
+	// PacketTypePong answers a ping by echoing its nonce
+	PacketTypePong PacketType = 0x0A
 )
 
+// PingNonceSize is the size of the nonce a ping carries and its pong echoes
+const PingNonceSize = 8
+
 // PacketHeader is the header of a VPN packet
 type PacketHeader struct {
 	Type      PacketType
-	Reserved  uint8
+	KeyEpoch  uint8 // Handshake generation whose keys protect the packet
 	Length    uint16
 	SessionID uint32
+	Counter   uint64 // Send counter, used as the AEAD nonce
 }
 
 // Packet represents a VPN packet
@@ -37,18 +62,25 @@ type Packet struct {
 	Data   []byte
 }
 
+// Encode encodes the header into bytes. Encrypted packets authenticate
+// these bytes as AEAD associated data.
+func (h *PacketHeader) Encode() []byte {
+	buf := make([]byte, PacketHeaderSize)
+
+	buf[0] = byte(h.Type)
+	buf[1] = h.KeyEpoch
+	binary.BigEndian.PutUint16(buf[2:4], h.Length)
+	binary.BigEndian.PutUint32(buf[4:8], h.SessionID)
+	binary.BigEndian.PutUint64(buf[8:16], h.Counter)
+
+	return buf
+}
+
 // Encode encodes a packet into bytes
 func (p *Packet) Encode() []byte {
-	buf := make([]byte, PacketHeaderSize+len(p.Data))
-	
-	buf[0] = byte(p.Header.Type)
-	buf[1] = p.Header.Reserved
-	binary.BigEndian.PutUint16(buf[2:4], p.Header.Length)
-	binary.BigEndian.PutUint32(buf[4:8], p.Header.SessionID)
-	
-	copy(buf[PacketHeaderSize:], p.Data)
-	
-	return buf
+	buf := make([]byte, 0, PacketHeaderSize+len(p.Data))
+	buf = append(buf, p.Header.Encode()...)
+	return append(buf, p.Data...)
 }
 
 // Decode decodes bytes into a packet
@@ -59,25 +91,42 @@ func Decode(data []byte) (*Packet, error) {
 
 	p := &Packet{}
 	p.Header.Type = PacketType(data[0])
-	p.Header.Reserved = data[1]
+	p.Header.KeyEpoch = data[1]
 	p.Header.Length = binary.BigEndian.Uint16(data[2:4])
 	p.Header.SessionID = binary.BigEndian.Uint32(data[4:8])
-	
+	p.Header.Counter = binary.BigEndian.Uint64(data[8:16])
+
 	if len(data) < PacketHeaderSize+int(p.Header.Length) {
 		return nil, errors.New("packet length mismatch")
 	}
-	
+
 	p.Data = make([]byte, p.Header.Length)
 	copy(p.Data, data[PacketHeaderSize:PacketHeaderSize+int(p.Header.Length)])
-	
+
 	return p, nil
 }
 
-// NewDataPacket creates a new data packet
-func NewDataPacket(sessionID uint32, data []byte) *Packet {
+// NewTransportPacket creates an encrypted packet whose sealed payload will be
+// length bytes long. Because the header is authenticated as associated data
+// it must be complete before encrypting; Data is set afterwards.
+func NewTransportPacket(t PacketType, sessionID uint32, epoch uint8, counter uint64, length int) *Packet {
+	return &Packet{
+		Header: PacketHeader{
+			Type:      t,
+			KeyEpoch:  epoch,
+			Length:    uint16(length),
+			SessionID: sessionID,
+			Counter:   counter,
+		},
+	}
+}
+
+// NewHandshakeInitPacket creates a new handshake init packet for a key epoch
+func NewHandshakeInitPacket(sessionID uint32, epoch uint8, data []byte) *Packet {
 	return &Packet{
 		Header: PacketHeader{
-			Type:      PacketTypeData,
+			Type:      PacketTypeHandshakeInit,
+			KeyEpoch:  epoch,
 			Length:    uint16(len(data)),
 			SessionID: sessionID,
 		},
@@ -85,18 +134,77 @@ func NewDataPacket(sessionID uint32, data []byte) *Packet {
 	}
 }
 
-// NewKeepAlivePacket creates a new keep-alive packet
-func NewKeepAlivePacket(sessionID uint32) *Packet {
+// NewHandshakeResponsePacket creates a new handshake response packet for a key epoch
+func NewHandshakeResponsePacket(sessionID uint32, epoch uint8, data []byte) *Packet {
 	return &Packet{
 		Header: PacketHeader{
-			Type:      PacketTypeKeepAlive,
-			Length:    0,
+			Type:      PacketTypeHandshakeResponse,
+			KeyEpoch:  epoch,
+			Length:    uint16(len(data)),
+			SessionID: sessionID,
+		},
+		Data: data,
+	}
+}
+
+// NewCookieReplyPacket creates a cookie reply to a handshake init for a key epoch
+func NewCookieReplyPacket(sessionID uint32, epoch uint8, data []byte) *Packet {
+	return &Packet{
+		Header: PacketHeader{
+			Type:      PacketTypeCookieReply,
+			KeyEpoch:  epoch,
+			Length:    uint16(len(data)),
 			SessionID: sessionID,
 		},
-		Data: nil,
+		Data: data,
 	}
 }
 
+// NewPingPacket creates a ping carrying a nonce and its MACs
+func NewPingPacket(data []byte) *Packet {
+	return &Packet{
+		Header: PacketHeader{
+			Type:   PacketTypePing,
+			Length: uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
+// NewPongPacket creates the answer to a ping with the given nonce
+func NewPongPacket(nonce []byte) *Packet {
+	return &Packet{
+		Header: PacketHeader{
+			Type:   PacketTypePong,
+			Length: uint16(len(nonce)),
+		},
+		Data: nonce,
+	}
+}
+
+// NewRejectPacket creates a reject answering a handshake init for a key epoch
+func NewRejectPacket(sessionID uint32, epoch uint8, reject Reject) *Packet {
+	data := reject.Encode()
+	return &Packet{
+		Header: PacketHeader{
+			Type:      PacketTypeReject,
+			KeyEpoch:  epoch,
+			Length:    uint16(len(data)),
+			SessionID: sessionID,
+		},
+		Data: data,
+	}
+}
+
+// IsEncrypted reports whether the packet payload is encrypted with session keys
+func (p *Packet) IsEncrypted() bool {
+	switch p.Header.Type {
+	case PacketTypeData, PacketTypeKeepAlive, PacketTypeRekey, PacketTypeControl:
+		return true
+	}
+	return false
+}
+
 // IsIPv4 checks if the packet data is an IPv4 packet
 func (p *Packet) IsIPv4() bool {
 	if len(p.Data) < 1 {
@@ -115,17 +223,46 @@ func (p *Packet) IsIPv6() bool {
 
 // GetDestinationIP extracts the destination IP from the packet (if IPv4/IPv6)
 func (p *Packet) GetDestinationIP() (net.IP, error) {
-	if p.IsIPv4() {
-		if len(p.Data) < 20 {
+	return DestinationIP(p.Data)
+}
+
+// DestinationIP extracts the destination address of an IPv4 or IPv6 packet
+func DestinationIP(data []byte) (net.IP, error) {
+	switch ipVersion(data) {
+	case 4:
+		if len(data) < 20 {
 			return nil, errors.New("packet too short for IPv4")
 		}
-		return net.IP(p.Data[16:20]), nil
+		return net.IP(data[16:20]), nil
+	case 6:
+		if len(data) < 40 {
+			return nil, errors.New("packet too short for IPv6")
+		}
+		return net.IP(data[24:40]), nil
 	}
-	if p.IsIPv6() {
-		if len(p.Data) < 40 {
+	return nil, errors.New("not an IP packet")
+}
+
+// SourceIP extracts the source address of an IPv4 or IPv6 packet
+func SourceIP(data []byte) (net.IP, error) {
+	switch ipVersion(data) {
+	case 4:
+		if len(data) < 20 {
+			return nil, errors.New("packet too short for IPv4")
+		}
+		return net.IP(data[12:16]), nil
+	case 6:
+		if len(data) < 40 {
 			return nil, errors.New("packet too short for IPv6")
 		}
-		return net.IP(p.Data[24:40]), nil
+		return net.IP(data[8:24]), nil
 	}
 	return nil, errors.New("not an IP packet")
 }
+
+func ipVersion(data []byte) byte {
+	if len(data) < 1 {
+		return 0
+	}
+	return data[0] >> 4
+}
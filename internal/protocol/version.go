@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Version is the wire protocol version spoken by this implementation
+	Version uint8 = 1
+	// MinVersion is the oldest protocol version still accepted from peers
+	MinVersion uint8 = 1
+	// HelloSize is the size of an encoded Hello
+	HelloSize = 5
+	// RejectSize is the size of an encoded Reject
+	RejectSize = 6
+)
+
+// Capabilities is a bitmap of optional protocol features a peer supports.
+// Unknown bits are ignored, so new features can be added without a new
+// protocol version; bits for compression, fragmentation and IPv6 will be
+// assigned when those features are implemented.
+type Capabilities uint32
+
+const (
+	// CapCipherSuites means the peer negotiates the transport cipher suite
+	CapCipherSuites Capabilities = 1 << iota
+	// CapHybridKEX means the peer can add ML-KEM-768 to the key exchange
+	CapHybridKEX
+	// CapAuthErrors means the peer understands authentication errors in
+	// handshake responses, such as a request for a one-time code
+	CapAuthErrors
+	// CapConfigPush means the server pushes the tunnel configuration after
+	// the handshake and the client waits for it
+	CapConfigPush
+	// CapKeepAlive means the server answers every keep-alive, so the client
+	// can tell a dead server from an idle tunnel
+	CapKeepAlive
+)
+
+var capabilityNames = []struct {
+	cap  Capabilities
+	name string
+}{
+	{CapCipherSuites, "cipher-suites"},
+	{CapHybridKEX, "hybrid-kex"},
+	{CapAuthErrors, "auth-errors"},
+	{CapConfigPush, "config-push"},
+	{CapKeepAlive, "keep-alive"},
+}
+
+// Has reports whether all capabilities in c2 are set
+func (c Capabilities) Has(c2 Capabilities) bool {
+	return c&c2 == c2
+}
+
+// String lists the names of the capabilities
+func (c Capabilities) String() string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+			c &^= n.cap
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Hello announces a client's protocol version and capabilities. It is sent
+// in the clear ahead of the Noise message in every handshake init so that
+// the server can refuse an incompatible client before decrypting anything.
+// Both sides also mix it into the handshake as prologue, so a tampered
+// hello fails the handshake.
+type Hello struct {
+	Version      uint8
+	Capabilities Capabilities
+}
+
+// Encode encodes the hello into bytes
+func (h Hello) Encode() []byte {
+	buf := []byte{h.Version}
+	return binary.BigEndian.AppendUint32(buf, uint32(h.Capabilities))
+}
+
+// DecodeHello splits a handshake init into its hello and the message that follows
+func DecodeHello(data []byte) (Hello, []byte, error) {
+	if len(data) < HelloSize {
+		return Hello{}, nil, errors.New("handshake init too short for hello")
+	}
+	h := Hello{
+		Version:      data[0],
+		Capabilities: Capabilities(binary.BigEndian.Uint32(data[1:HelloSize])),
+	}
+	return h, data[HelloSize:], nil
+}
+
+// RejectReason says why a server refused a handshake init
+type RejectReason uint8
+
+const (
+	// RejectVersion means the client's protocol version is not supported
+	RejectVersion RejectReason = 0x01
+	// RejectCapabilities means the client lacks a capability the server requires
+	RejectCapabilities RejectReason = 0x02
+)
+
+// Reject is the payload of a reject packet: the reason and what the server
+// speaks, so the client can report what to upgrade. It is not authenticated
+// and only ever ends a handshake in progress.
+type Reject struct {
+	Reason       RejectReason
+	Version      uint8
+	Capabilities Capabilities // Capabilities the server requires
+}
+
+// Encode encodes the reject into bytes
+func (r Reject) Encode() []byte {
+	buf := []byte{byte(r.Reason), r.Version}
+	return binary.BigEndian.AppendUint32(buf, uint32(r.Capabilities))
+}
+
+// DecodeReject decodes the payload of a reject packet
+func DecodeReject(data []byte) (Reject, error) {
+	if len(data) != RejectSize {
+		return Reject{}, errors.New("invalid reject length")
+	}
+	return Reject{
+		Reason:       RejectReason(data[0]),
+		Version:      data[1],
+		Capabilities: Capabilities(binary.BigEndian.Uint32(data[2:])),
+	}, nil
+}
+
+// Error describes the rejection from the client's point of view
+func (r Reject) Error() string {
+	switch r.Reason {
+	case RejectVersion:
+		return fmt.Sprintf("server does not support protocol version %d (server speaks version %d)", Version, r.Version)
+	case RejectCapabilities:
+		return fmt.Sprintf("server requires capabilities this client lacks (%s)", r.Capabilities)
+	}
+	return fmt.Sprintf("server rejected the handshake (reason %d)", r.Reason)
+}
@@ -6,19 +6,24 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 // Route represents a network route
 type Route struct {
 	Destination *net.IPNet
-	Gateway    net.IP
-	Interface  string
-	Metric     int
+	Gateway     net.IP
+	Interface   string
+	Metric      int
 }
 
 // Manager handles routing table operations
 type Manager struct {
 	interfaceName string
+
+	mu           sync.Mutex
+	added        []*net.IPNet // Routes through the interface added by AddRoute
+	serverRoutes []Route      // Host routes to the server, outside the tunnel
 }
 
 // NewManager creates a new routing manager
@@ -30,32 +35,47 @@ func NewManager(interfaceName string) *Manager {
 
 // AddRoute adds a route through the VPN interface
 func (m *Manager) AddRoute(dest *net.IPNet) error {
+	var added bool
+	var err error
 	switch runtime.GOOS {
 	case "linux":
-		return m.addRouteLinux(dest)
+		added, err = m.addRouteLinux(dest)
 	case "darwin":
-		return m.addRouteDarwin(dest)
+		added, err = m.addRouteDarwin(dest)
 	default:
 		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
+
+	// Only routes added here are removed by Cleanup; one that existed
+	// already, such as the kernel's route to the interface's own network,
+	// stays
+	if added {
+		m.mu.Lock()
+		m.added = append(m.added, dest)
+		m.mu.Unlock()
+	}
+	return err
 }
 
-func (m *Manager) addRouteLinux(dest *net.IPNet) error {
+func (m *Manager) addRouteLinux(dest *net.IPNet) (bool, error) {
 	cmd := exec.Command("ip", "route", "add", dest.String(), "dev", m.interfaceName)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		// Ignore "File exists" error (route already exists)
 		if strings.Contains(string(output), "File exists") {
-			return nil
+			return false, nil
 		}
-		return fmt.Errorf("failed to add route: %w: %s", err, string(output))
+		return false, fmt.Errorf("failed to add route: %w: %s", err, string(output))
 	}
-	return nil
+	return true, nil
 }
 
-func (m *Manager) addRouteDarwin(dest *net.IPNet) error {
+func (m *Manager) addRouteDarwin(dest *net.IPNet) (bool, error) {
 	cmd := exec.Command("route", "add", "-net", dest.String(), "-interface", m.interfaceName)
-	return cmd.Run()
+	if err := cmd.Run(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // DeleteRoute removes a route
@@ -101,23 +121,23 @@ func (m *Manager) listRoutesLinux() ([]Route, error) {
 
 	var routes []Route
 	lines := strings.Split(string(output), "\n")
-	
+
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
-		
+
 		fields := strings.Fields(line)
 		if len(fields) < 2 {
 			continue
 		}
-		
+
 		// Parse route line: "10.0.0.0/24 dev omail0"
 		var dest *net.IPNet
 		var gateway net.IP
 		var iface string
-		
+
 		for i, field := range fields {
 			if field == "dev" && i+1 < len(fields) {
 				iface = fields[i+1]
@@ -129,7 +149,7 @@ func (m *Manager) listRoutesLinux() ([]Route, error) {
 				_, dest, _ = net.ParseCIDR(field)
 			}
 		}
-		
+
 		if dest != nil {
 			routes = append(routes, Route{
 				Destination: dest,
@@ -138,7 +158,7 @@ func (m *Manager) listRoutesLinux() ([]Route, error) {
 			})
 		}
 	}
-	
+
 	return routes, nil
 }
 
@@ -151,25 +171,25 @@ func (m *Manager) listRoutesDarwin() ([]Route, error) {
 
 	var routes []Route
 	lines := strings.Split(string(output), "\n")
-	
+
 	for _, line := range lines {
 		fields := strings.Fields(line)
 		if len(fields) < 4 {
 			continue
 		}
-		
+
 		// Parse netstat output format
 		dest := fields[0]
 		gateway := fields[1]
 		flags := fields[2]
 		iface := fields[3]
-		
+
 		if strings.Contains(flags, "U") && iface == m.interfaceName {
 			_, ipNet, err := net.ParseCIDR(dest)
 			if err != nil {
 				continue
 			}
-			
+
 			routes = append(routes, Route{
 				Destination: ipNet,
 				Gateway:     net.ParseIP(gateway),
@@ -177,14 +197,190 @@ func (m *Manager) listRoutesDarwin() ([]Route, error) {
 			})
 		}
 	}
-	
+
 	return routes, nil
 }
 
-// SetupDefaultRoute sets up default routing through VPN (for full tunnel)
-func (m *Manager) SetupDefaultRoute() error {
-	_, defaultRoute, _ := net.ParseCIDR("0.0.0.0/0")
-	return m.AddRoute(defaultRoute)
+// SetupDefaultRoute sets up default routing through VPN (for full tunnel).
+// The server itself stays reachable through a host route via the gateway
+// that served it so far, so that the tunnel's own packets do not loop into
+// the tunnel. Instead of replacing the default route, two half routes,
+// 0.0.0.0/1 and 128.0.0.0/1, win over it by being more specific; the
+// original default is left alone and takes over again on Cleanup.
+func (m *Manager) SetupDefaultRoute(server net.IP) error {
+	if err := m.pinServerRoute(server); err != nil {
+		return fmt.Errorf("failed to keep route to server %s: %w", server, err)
+	}
+
+	for _, half := range []string{"0.0.0.0/1", "128.0.0.0/1"} {
+		_, network, _ := net.ParseCIDR(half)
+		if err := m.AddRoute(network); err != nil {
+			return fmt.Errorf("failed to add route for %s: %w", half, err)
+		}
+	}
+	return nil
+}
+
+// pinServerRoute adds a host route to the server via its current gateway
+// and interface, unless the server is reached through loopback or such a
+// route already exists
+func (m *Manager) pinServerRoute(server net.IP) error {
+	route, err := m.routeTo(server)
+	if err != nil {
+		return err
+	}
+	if route.Interface == m.interfaceName {
+		return fmt.Errorf("the server is only reachable through %s", m.interfaceName)
+	}
+	if route.Interface == "lo" || route.Interface == "lo0" {
+		return nil
+	}
+
+	var added bool
+	switch runtime.GOOS {
+	case "linux":
+		added, err = addHostRouteLinux(route)
+	case "darwin":
+		added, err = addHostRouteDarwin(route)
+	}
+	if err != nil || !added {
+		return err
+	}
+
+	m.mu.Lock()
+	m.serverRoutes = append(m.serverRoutes, route)
+	m.mu.Unlock()
+	return nil
+}
+
+// routeTo returns the host route the system currently uses for ip
+func (m *Manager) routeTo(ip net.IP) (Route, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return routeToLinux(ip)
+	case "darwin":
+		return routeToDarwin(ip)
+	default:
+		return Route{}, fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+	}
+}
+
+func routeToLinux(ip net.IP) (Route, error) {
+	// Output: "203.0.113.5 via 192.168.1.1 dev eth0 src 192.168.1.20 uid 0"
+	output, err := exec.Command("ip", "route", "get", ip.String()).CombinedOutput()
+	if err != nil {
+		return Route{}, fmt.Errorf("failed to look up route: %w: %s", err, string(output))
+	}
+
+	route := Route{Destination: hostNetwork(ip)}
+	fields := strings.Fields(string(output))
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "via":
+			route.Gateway = net.ParseIP(fields[i+1])
+		case "dev":
+			route.Interface = fields[i+1]
+		}
+	}
+	if route.Interface == "" {
+		return Route{}, fmt.Errorf("no route to %s", ip)
+	}
+	return route, nil
+}
+
+func routeToDarwin(ip net.IP) (Route, error) {
+	// Output contains lines like "gateway: 192.168.1.1" and "interface: en0"
+	output, err := exec.Command("route", "-n", "get", ip.String()).CombinedOutput()
+	if err != nil {
+		return Route{}, fmt.Errorf("failed to look up route: %w: %s", err, string(output))
+	}
+
+	route := Route{Destination: hostNetwork(ip)}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			route.Gateway = net.ParseIP(strings.TrimSpace(value))
+		case "interface":
+			route.Interface = strings.TrimSpace(value)
+		}
+	}
+	if route.Interface == "" {
+		return Route{}, fmt.Errorf("no route to %s", ip)
+	}
+	return route, nil
+}
+
+// addHostRouteLinux adds a route and reports whether it was added, as
+// opposed to existing already
+func addHostRouteLinux(route Route) (bool, error) {
+	output, err := exec.Command("ip", hostRouteArgsLinux("add", route)...).CombinedOutput()
+	if err != nil {
+		// Ignore "File exists" error (route already exists)
+		if strings.Contains(string(output), "File exists") {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to add route: %w: %s", err, string(output))
+	}
+	return true, nil
+}
+
+func addHostRouteDarwin(route Route) (bool, error) {
+	args := []string{"add", "-host", route.Destination.IP.String()}
+	if route.Gateway != nil {
+		args = append(args, route.Gateway.String())
+	} else {
+		args = append(args, "-interface", route.Interface)
+	}
+	output, err := exec.Command("route", args...).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(output), "File exists") {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to add route: %w: %s", err, string(output))
+	}
+	return true, nil
+}
+
+func hostRouteArgsLinux(action string, route Route) []string {
+	args := []string{"route", action, route.Destination.String()}
+	if route.Gateway != nil {
+		args = append(args, "via", route.Gateway.String())
+	}
+	return append(args, "dev", route.Interface)
+}
+
+// deleteServerRoutes removes the host routes added by pinServerRoute
+func (m *Manager) deleteServerRoutes() {
+	m.mu.Lock()
+	routes := m.serverRoutes
+	m.serverRoutes = nil
+	m.mu.Unlock()
+
+	for _, route := range routes {
+		var err error
+		switch runtime.GOOS {
+		case "linux":
+			err = exec.Command("ip", hostRouteArgsLinux("del", route)...).Run()
+		case "darwin":
+			err = exec.Command("route", "delete", "-host", route.Destination.IP.String()).Run()
+		}
+		if err != nil {
+			// Log but continue
+			fmt.Printf("Warning: failed to delete route %s: %v\n", route.Destination.String(), err)
+		}
+	}
+}
+
+// hostNetwork returns the single-address network of ip
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
 }
 
 // SetupSplitTunnel sets up split tunneling (only route specific networks)
@@ -197,21 +393,143 @@ func (m *Manager) SetupSplitTunnel(networks []*net.IPNet) error {
 	return nil
 }
 
-// Cleanup removes all routes through the VPN interface
+// Cleanup removes the routes added through the VPN interface and the host
+// routes to the server that kept it outside the tunnel. The route the
+// system keeps to the interface's own network stays, so a reconnect that
+// keeps the interface up does not lose it.
 func (m *Manager) Cleanup() error {
-	routes, err := m.ListRoutes()
-	if err != nil {
-		return err
+	m.mu.Lock()
+	routes := m.added
+	m.added = nil
+	m.mu.Unlock()
+
+	for _, dest := range routes {
+		if err := m.DeleteRoute(dest); err != nil {
+			// Log but continue
+			fmt.Printf("Warning: failed to delete route %s: %v\n", dest.String(), err)
+		}
 	}
-	
-	for _, route := range routes {
-		if route.Interface == m.interfaceName {
-			if err := m.DeleteRoute(route.Destination); err != nil {
-				// Log but continue
-				fmt.Printf("Warning: failed to delete route %s: %v\n", route.Destination.String(), err)
-			}
+
+	m.deleteServerRoutes()
+	return nil
+}
+
+// SetDNS points name resolution at the given servers while the VPN interface
+// is up. For a full tunnel they become the default for all names. The
+// setting disappears with the interface.
+func (m *Manager) SetDNS(servers []net.IP, fullTunnel bool) error {
+	switch runtime.GOOS {
+	case "linux":
+		return m.setDNSLinux(servers, fullTunnel)
+	default:
+		return fmt.Errorf("setting DNS servers is not supported on %s", runtime.GOOS)
+	}
+}
+
+func (m *Manager) setDNSLinux(servers []net.IP, fullTunnel bool) error {
+	args := []string{"dns", m.interfaceName}
+	for _, server := range servers {
+		args = append(args, server.String())
+	}
+	if output, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set DNS servers: %w: %s", err, string(output))
+	}
+
+	if fullTunnel {
+		// "~." makes the interface's servers the default for all names
+		output, err := exec.Command("resolvectl", "domain", m.interfaceName, "~.").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to set DNS domain: %w: %s", err, string(output))
+		}
+	}
+	return nil
+}
+
+// killSwitchTable is the nftables table holding the kill switch rules for
+// the VPN interface
+func (m *Manager) killSwitchTable() string {
+	return "omail-" + m.interfaceName
+}
+
+// SetKillSwitch blocks all traffic except over the VPN interface, over
+// loopback and to and from the given server endpoints, so that nothing
+// leaks onto the plain network while the tunnel is down. DHCP and IPv6
+// neighbor discovery stay allowed to keep the path to the server working. Calling it again
+// replaces the allowed endpoints atomically. Routing cleanup leaves the
+// rules alone; only RemoveKillSwitch lifts them.
+func (m *Manager) SetKillSwitch(servers []*net.UDPAddr) error {
+	switch runtime.GOOS {
+	case "linux":
+		return m.setKillSwitchLinux(servers)
+	default:
+		return fmt.Errorf("kill switch is not supported on %s", runtime.GOOS)
+	}
+}
+
+func (m *Manager) setKillSwitchLinux(servers []*net.UDPAddr) error {
+	table := m.killSwitchTable()
+
+	var out, in strings.Builder
+	for _, server := range servers {
+		family := "ip6"
+		if server.IP.To4() != nil {
+			family = "ip"
+		}
+		fmt.Fprintf(&out, "\t\t%s daddr %s udp dport %d accept\n", family, server.IP, server.Port)
+		fmt.Fprintf(&in, "\t\t%s saddr %s udp sport %d accept\n", family, server.IP, server.Port)
+	}
+
+	// Creating the table before deleting it makes the delete succeed when
+	// it does not exist yet; nft applies the whole script in one
+	// transaction, so no packet slips through while the rules are replaced
+	ruleset := fmt.Sprintf(`table inet %[1]s
+delete table inet %[1]s
+table inet %[1]s {
+	chain output {
+		type filter hook output priority 0; policy drop;
+		oifname "lo" accept
+		oifname "%[2]s" accept
+		udp sport 68 udp dport 67 accept
+		udp sport 546 udp dport 547 accept
+		icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept
+%[3]s	}
+	chain input {
+		type filter hook input priority 0; policy drop;
+		iifname "lo" accept
+		iifname "%[2]s" accept
+		udp sport 67 udp dport 68 accept
+		udp sport 547 udp dport 546 accept
+		icmpv6 type { nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert, nd-redirect } accept
+%[4]s	}
+}
+`, table, m.interfaceName, out.String(), in.String())
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set kill switch: %w: %s", err, string(output))
+	}
+	return nil
+}
+
+// RemoveKillSwitch lifts the rules installed by SetKillSwitch, if any
+func (m *Manager) RemoveKillSwitch() error {
+	switch runtime.GOOS {
+	case "linux":
+		return m.removeKillSwitchLinux()
+	default:
+		return nil
+	}
+}
+
+func (m *Manager) removeKillSwitchLinux() error {
+	output, err := exec.Command("nft", "delete", "table", "inet", m.killSwitchTable()).CombinedOutput()
+	if err != nil {
+		// Ignore "No such file or directory" (no kill switch installed)
+		if strings.Contains(string(output), "No such file") {
+			return nil
 		}
+		return fmt.Errorf("failed to remove kill switch: %w: %s", err, string(output))
 	}
-	
 	return nil
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+const (
+	// passwordWorkers is how many password hashes are verified at once.
+	// Each Argon2id verification takes DefaultPasswordParams.Memory.
+	passwordWorkers = 4
+	// passwordQueueSize is how many verifications may wait for a worker
+	passwordQueueSize = 64
+	// passwordsPerSource is how many verifications one source address may
+	// have waiting or running at once
+	passwordsPerSource = 2
+)
+
+// passwordVerifier verifies user passwords off the UDP read loop, so that
+// the Argon2id work of password handshakes does not stall the tunnels. Its
+// queue is bounded, overall and per source address; handshakes that do not
+// fit are dropped and retried by their clients.
+type passwordVerifier struct {
+	jobs chan func()
+	// dummyHash is verified for unknown users, so that the time taken does
+	// not tell whether a user name exists
+	dummyHash string
+
+	mu      sync.Mutex
+	pending map[string]int // Verifications per source address
+}
+
+func newPasswordVerifier() (*passwordVerifier, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	dummyHash, err := crypto.HashPassword(string(secret), crypto.DefaultPasswordParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passwordVerifier{
+		jobs:      make(chan func(), passwordQueueSize),
+		dummyHash: dummyHash,
+		pending:   make(map[string]int),
+	}, nil
+}
+
+// submit queues a verification for a source address. It reports false if
+// the source or the queue is at its limit.
+func (v *passwordVerifier) submit(source net.IP, job func()) bool {
+	key := string(source.To16())
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pending[key] >= passwordsPerSource {
+		return false
+	}
+
+	done := func() {
+		defer v.release(key)
+		job()
+	}
+	select {
+	case v.jobs <- done:
+		v.pending[key]++
+		return true
+	default:
+		return false
+	}
+}
+
+func (v *passwordVerifier) release(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pending[key]--; v.pending[key] <= 0 {
+		delete(v.pending, key)
+	}
+}
+
+// verify reports whether password is the password of a user. Unknown users
+// and users without a password take as long as the others to fail.
+func (v *passwordVerifier) verify(hash, password string) bool {
+	if hash == "" {
+		crypto.VerifyPassword(password, v.dummyHash)
+		return false
+	}
+
+	match, err := crypto.VerifyPassword(password, hash)
+	if err != nil {
+		log.Printf("Invalid password hash: %v", err)
+		return false
+	}
+	return match
+}
+
+// verifyPasswords runs a worker of the password verifier until the server
+// stops
+func (s *Server) verifyPasswords() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case job := <-s.passwords.jobs:
+			job()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+func TestPasswordVerifierLimits(t *testing.T) {
+	v, err := newPasswordVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without workers running, jobs stay queued
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	for i := 0; i < passwordsPerSource; i++ {
+		if !v.submit(a, func() {}) {
+			t.Fatalf("verification %d refused", i)
+		}
+	}
+	if v.submit(a, func() {}) {
+		t.Fatal("source exceeded its limit")
+	}
+	if !v.submit(b, func() {}) {
+		t.Fatal("another source refused")
+	}
+
+	// A finished verification frees its source's slot
+	(<-v.jobs)()
+	if !v.submit(a, func() {}) {
+		t.Fatal("source still at its limit after a verification finished")
+	}
+}
+
+func TestPasswordVerifierQueueFull(t *testing.T) {
+	v := &passwordVerifier{jobs: make(chan func(), 1), pending: make(map[string]int)}
+
+	if !v.submit(net.ParseIP("192.0.2.1"), func() {}) {
+		t.Fatal("first verification refused")
+	}
+	if v.submit(net.ParseIP("192.0.2.2"), func() {}) {
+		t.Fatal("verification queued beyond the queue size")
+	}
+	if n := v.pending[string(net.ParseIP("192.0.2.2").To16())]; n != 0 {
+		t.Fatalf("refused verification counted as pending: %d", n)
+	}
+}
+
+func TestPasswordVerifierVerify(t *testing.T) {
+	v, err := newPasswordVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := crypto.HashPassword("secret", crypto.PasswordParams{Memory: 64, Time: 1, Threads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.verify(hash, "secret") {
+		t.Fatal("correct password refused")
+	}
+	if v.verify(hash, "wrong") {
+		t.Fatal("wrong password accepted")
+	}
+	if v.verify("", "secret") {
+		t.Fatal("user without a password accepted")
+	}
+	if v.verify("$argon2id$broken", "secret") {
+		t.Fatal("malformed hash accepted")
+	}
+}
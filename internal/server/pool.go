@@ -0,0 +1,368 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nees/omail/internal/crypto"
+)
+
+// DefaultLeaseTime is how long a client's address stays reserved for it
+// after its last session ends
+const DefaultLeaseTime = 24 * time.Hour
+
+// minLeaseTime keeps leases longer than the interval at which the leases of
+// connected clients are renewed
+const minLeaseTime = time.Minute
+
+// errPoolExhausted is returned when every address in the pool is leased
+var errPoolExhausted = errors.New("address pool exhausted")
+
+// errAddressInUse is returned when a client's fixed address is the
+// server's own or is held by a session of another key
+var errAddressInUse = errors.New("fixed address in use by another session")
+
+// lease reserves a pool address for an owner: a user name or a client key
+type lease struct {
+	IP      net.IP    `json:"ip"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// addressPool hands out tunnel IPs from an IPv4 network. An owner keeps its
+// address across sessions for as long as its lease is renewed, and the
+// lease table is saved to disk so that this survives restarts.
+type addressPool struct {
+	network   *net.IPNet
+	leaseTime time.Duration
+	path      string // Lease file; empty to keep leases in memory only
+
+	mu       sync.Mutex
+	reserved map[uint32]bool // Never handed out: server and static addresses
+	leases   map[string]*lease
+	byIP     map[uint32]*lease
+	dirty    bool // Leases changed since the last save
+}
+
+// newAddressPool creates a pool over an IPv4 network, loading the leases
+// saved in path if it exists. The network and broadcast addresses and the
+// reserved addresses are never handed out.
+func newAddressPool(network *net.IPNet, reserved []net.IP, leaseTime time.Duration, path string) (*addressPool, error) {
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("address pool %s is not an IPv4 network", network)
+	}
+	if ones, bits := network.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("address pool %s is too small", network)
+	} else if bits-ones > 24 {
+		return nil, fmt.Errorf("address pool %s is too large", network)
+	}
+	if leaseTime <= 0 {
+		leaseTime = DefaultLeaseTime
+	}
+
+	p := &addressPool{
+		network:   network,
+		leaseTime: leaseTime,
+		path:      path,
+		reserved:  make(map[uint32]bool),
+		leases:    make(map[string]*lease),
+		byIP:      make(map[uint32]*lease),
+	}
+
+	first, last := p.bounds()
+	p.reserved[first-1] = true // Network address
+	p.reserved[last+1] = true  // Broadcast address
+	for _, ip := range reserved {
+		if p.contains(ip) {
+			p.reserved[ipToUint32(ip)] = true
+		}
+	}
+
+	if path != "" {
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// acquire returns the owner's address, renewing its lease, or leases it
+// the first free address
+func (p *addressPool) acquire(owner string) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := p.leases[owner]; ok {
+		l.Expires = now.Add(p.leaseTime)
+		p.dirty = true
+		return l.IP, nil
+	}
+
+	p.expireLocked(now)
+
+	first, last := p.bounds()
+	for n := first; n <= last; n++ {
+		if p.reserved[n] || p.byIP[n] != nil {
+			continue
+		}
+		l := &lease{IP: uint32ToIP(n), Owner: owner, Expires: now.Add(p.leaseTime)}
+		p.leases[owner] = l
+		p.byIP[n] = l
+		p.dirty = true
+
+		// Save new leases at once; renewals wait for the next expire
+		if err := p.saveLocked(); err != nil {
+			log.Printf("Failed to save address leases: %v", err)
+		}
+		return l.IP, nil
+	}
+	return nil, errPoolExhausted
+}
+
+// lookup returns the address leased to an owner
+func (p *addressPool) lookup(owner string) (net.IP, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if l, ok := p.leases[owner]; ok {
+		return l.IP, true
+	}
+	return nil, false
+}
+
+// reserve stops handing out a fixed address that was not known when the
+// pool was created, such as one from a client certificate. A lease on it
+// is dropped, and its owner gets another address on its next session.
+func (p *addressPool) reserve(ip net.IP) {
+	if !p.contains(ip) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := ipToUint32(ip)
+	if p.reserved[n] {
+		return
+	}
+	p.reserved[n] = true
+	if l := p.byIP[n]; l != nil {
+		log.Printf("Dropped lease of %s to %s: the address is fixed for another client", l.IP, l.Owner)
+		delete(p.leases, l.Owner)
+		delete(p.byIP, n)
+		p.dirty = true
+		if err := p.saveLocked(); err != nil {
+			log.Printf("Failed to save address leases: %v", err)
+		}
+	}
+}
+
+// renew extends the leases of owners that are still connected
+func (p *addressPool) renew(owners []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	expires := time.Now().Add(p.leaseTime)
+	for _, owner := range owners {
+		if l, ok := p.leases[owner]; ok {
+			l.Expires = expires
+			p.dirty = true
+		}
+	}
+}
+
+// expire reclaims expired leases and saves the lease table if it changed
+func (p *addressPool) expire() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireLocked(time.Now())
+	return p.saveLocked()
+}
+
+func (p *addressPool) expireLocked(now time.Time) {
+	for owner, l := range p.leases {
+		if now.After(l.Expires) {
+			delete(p.leases, owner)
+			delete(p.byIP, ipToUint32(l.IP))
+			p.dirty = true
+		}
+	}
+}
+
+// leaseFile is the on-disk format of the lease table
+type leaseFile struct {
+	Network string   `json:"network"`
+	Leases  []*lease `json:"leases"`
+}
+
+// load reads the saved lease table. Leases outside the pool, for reserved
+// addresses or already expired are dropped, so the pool can be resized.
+func (p *addressPool) load() error {
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file leaseFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", p.path, err)
+	}
+
+	now := time.Now()
+	for _, l := range file.Leases {
+		if l.Owner == "" || !p.contains(l.IP) || now.After(l.Expires) {
+			continue
+		}
+		n := ipToUint32(l.IP)
+		if p.reserved[n] || p.byIP[n] != nil || p.leases[l.Owner] != nil {
+			continue
+		}
+		l.IP = l.IP.To4()
+		p.leases[l.Owner] = l
+		p.byIP[n] = l
+	}
+	return nil
+}
+
+// saveLocked writes the lease table if it changed, replacing the file
+// atomically so that a crash never leaves a truncated table
+func (p *addressPool) saveLocked() error {
+	if p.path == "" || !p.dirty {
+		return nil
+	}
+
+	file := leaseFile{Network: p.network.String()}
+	for _, l := range p.leases {
+		file.Leases = append(file.Leases, l)
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".leases-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p.path); err != nil {
+		return err
+	}
+
+	p.dirty = false
+	return nil
+}
+
+// bounds returns the first and last host addresses of the pool
+func (p *addressPool) bounds() (uint32, uint32) {
+	base := ipToUint32(p.network.IP)
+	ones, bits := p.network.Mask.Size()
+	size := uint32(1) << (bits - ones)
+	return base + 1, base + size - 2
+}
+
+func (p *addressPool) contains(ip net.IP) bool {
+	return ip.To4() != nil && p.network.Contains(ip)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// assignAddress returns the tunnel IP for a new session: the user's fixed
+// address, or one leased from the pool. It returns nil without a pool, and
+// the client then has to bring its own address.
+func (s *Server) assignAddress(client *Client) (net.IP, error) {
+	if client.user != nil && client.user.TunnelIP != nil {
+		// A fixed address serves one session at a time, even between
+		// keys of the same user
+		ip := client.user.TunnelIP
+		if ip.Equal(s.tunIP) || s.addressInUse(ip, client.PublicKey) {
+			return nil, fmt.Errorf("%w: %s", errAddressInUse, ip)
+		}
+		if s.pool != nil {
+			s.pool.reserve(ip)
+		}
+		return ip, nil
+	}
+	if s.pool == nil {
+		return nil, nil
+	}
+
+	// A user keeps its address whatever key it connects with, unless
+	// another of its sessions is using it
+	owner := "key:" + client.PublicKey.String()
+	if client.user != nil {
+		owner = "user:" + client.user.Name
+		if ip, ok := s.pool.lookup(owner); ok && s.addressInUse(ip, client.PublicKey) {
+			owner = "key:" + client.PublicKey.String()
+		}
+	}
+
+	ip, err := s.pool.acquire(owner)
+	if err != nil {
+		return nil, err
+	}
+	client.lease = owner
+	return ip, nil
+}
+
+// addressInUse reports whether a session of another key holds ip
+func (s *Server) addressInUse(ip net.IP, key crypto.PublicKey) bool {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	for _, client := range s.clients {
+		if client.PublicKey != key && client.TunnelIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// renewLeases extends the leases of connected clients, reclaims expired
+// ones and saves the lease table
+func (s *Server) renewLeases() {
+	if s.pool == nil {
+		return
+	}
+
+	s.clientsMu.RLock()
+	owners := make([]string, 0, len(s.clients))
+	for _, client := range s.clients {
+		if client.lease != "" {
+			owners = append(owners, client.lease)
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	s.pool.renew(owners)
+	if err := s.pool.expire(); err != nil {
+		log.Printf("Failed to save address leases: %v", err)
+	}
+}
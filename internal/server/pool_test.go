@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nees/omail/internal/auth"
+	"github.com/nees/omail/internal/crypto"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+// testServer returns a server for the tunnel network 10.0.0.0/24, with the
+// address 10.0.0.1 and no TUN or socket. Its pool, if any, is 10.0.0.128/29.
+func testServer(t *testing.T, users *auth.UserDB, withPool bool) *Server {
+	t.Helper()
+
+	tunIP := net.ParseIP("10.0.0.1").To4()
+	s := &Server{
+		users:   users,
+		tunIP:   tunIP,
+		tunMask: net.CIDRMask(24, 32),
+		tunNet:  mustParseCIDR(t, "10.0.0.0/24"),
+		clients: make(map[uint32]*Client),
+		routes:  newRouteTable(),
+	}
+	if withPool {
+		pool, err := newAddressPool(mustParseCIDR(t, "10.0.0.128/29"), users.TunnelIPs(), time.Hour, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.pool = pool
+	}
+	return s
+}
+
+// testKey returns a distinct client key for each n
+func testKey(n byte) crypto.PublicKey {
+	return crypto.PublicKey{n}
+}
+
+func TestAddressPoolExhaustion(t *testing.T) {
+	network := mustParseCIDR(t, "10.0.0.0/29")
+	pool, err := newAddressPool(network, []net.IP{net.ParseIP("10.0.0.1")}, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// .0 and .7 are the network and broadcast addresses, .1 is reserved
+	for i, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		ip, err := pool.acquire(string(rune('a' + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != want {
+			t.Fatalf("lease %d: got %s, want %s", i, ip, want)
+		}
+	}
+	if _, err := pool.acquire("f"); !errors.Is(err, errPoolExhausted) {
+		t.Fatalf("got %v, want errPoolExhausted", err)
+	}
+
+	// An owner keeps its address when the pool is full
+	if ip, err := pool.acquire("c"); err != nil || ip.String() != "10.0.0.4" {
+		t.Fatalf("renewal: got %s, %v", ip, err)
+	}
+
+	// An expired lease frees its address for the next owner
+	pool.leases["b"].Expires = time.Now().Add(-time.Second)
+	if ip, err := pool.acquire("f"); err != nil || ip.String() != "10.0.0.3" {
+		t.Fatalf("after expiry: got %s, %v", ip, err)
+	}
+	if _, ok := pool.lookup("b"); ok {
+		t.Fatal("expired lease still held")
+	}
+}
+
+func TestAddressPoolRenew(t *testing.T) {
+	pool, err := newAddressPool(mustParseCIDR(t, "10.0.0.0/29"), nil, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.acquire("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.acquire("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	pool.leases["a"].Expires = past
+	pool.leases["b"].Expires = past
+	pool.renew([]string{"a"})
+	if err := pool.expire(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := pool.lookup("a"); !ok {
+		t.Fatal("renewed lease expired")
+	}
+	if _, ok := pool.lookup("b"); ok {
+		t.Fatal("lease not renewed survived")
+	}
+}
+
+func TestAddressPoolReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	network := mustParseCIDR(t, "10.0.0.0/29")
+
+	pool, err := newAddressPool(network, nil, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased := make(map[string]net.IP)
+	for _, owner := range []string{"user:alice", "user:bob", "key:carol"} {
+		ip, err := pool.acquire(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leased[owner] = ip
+	}
+
+	pool, err = newAddressPool(network, nil, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for owner, want := range leased {
+		if ip, ok := pool.lookup(owner); !ok || !ip.Equal(want) {
+			t.Fatalf("%s: got %s, %v after reload, want %s", owner, ip, ok, want)
+		}
+	}
+
+	// Leases for addresses reserved since, or no longer handed out by a
+	// resized pool, are dropped
+	pool, err = newAddressPool(mustParseCIDR(t, "10.0.0.0/30"), []net.IP{leased["user:bob"]}, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := pool.lookup("user:alice"); !ok || !ip.Equal(leased["user:alice"]) {
+		t.Fatalf("alice: got %s, %v", ip, ok)
+	}
+	if _, ok := pool.lookup("user:bob"); ok {
+		t.Fatal("lease of a reserved address survived the reload")
+	}
+	if _, ok := pool.lookup("key:carol"); ok {
+		t.Fatal("lease of the broadcast address survived the reload")
+	}
+}
+
+func TestAddressPoolReserve(t *testing.T) {
+	pool, err := newAddressPool(mustParseCIDR(t, "10.0.0.0/29"), nil, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := pool.acquire("key:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.reserve(ip)
+	if _, ok := pool.lookup("key:a"); ok {
+		t.Fatal("lease of a reserved address kept")
+	}
+	other, err := pool.acquire("key:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Equal(ip) {
+		t.Fatal("reserved address leased again")
+	}
+
+	// Addresses outside the pool are ignored
+	pool.reserve(net.ParseIP("192.168.1.1"))
+}
+
+func TestAssignAddressFixed(t *testing.T) {
+	users := auth.NewUserDB()
+	alice := &auth.User{Name: "alice", TunnelIP: net.ParseIP("10.0.0.2").To4()}
+	if err := users.Add(alice); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, users, true)
+
+	first := &Client{SessionID: 1, PublicKey: testKey(1), user: alice}
+	ip, err := s.assignAddress(first)
+	if err != nil || !ip.Equal(alice.TunnelIP) {
+		t.Fatalf("got %s, %v", ip, err)
+	}
+	first.TunnelIP = ip
+	s.addClientLocked(first)
+
+	// A second key of the same user cannot take the address over
+	second := &Client{SessionID: 2, PublicKey: testKey(2), user: alice}
+	if _, err := s.assignAddress(second); !errors.Is(err, errAddressInUse) {
+		t.Fatalf("second key: got %v, want errAddressInUse", err)
+	}
+
+	// The same key replaces its own session and keeps the address
+	again := &Client{SessionID: 3, PublicKey: testKey(1), user: alice}
+	if ip, err := s.assignAddress(again); err != nil || !ip.Equal(alice.TunnelIP) {
+		t.Fatalf("same key: got %s, %v", ip, err)
+	}
+
+	// Nobody may be given the server's own address
+	server := &Client{SessionID: 4, PublicKey: testKey(4), user: &auth.User{Name: "mallory", TunnelIP: s.tunIP}}
+	if _, err := s.assignAddress(server); !errors.Is(err, errAddressInUse) {
+		t.Fatalf("server address: got %v, want errAddressInUse", err)
+	}
+}
+
+func TestAssignAddressCertificateInPool(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), true)
+
+	leased := &Client{SessionID: 1, PublicKey: testKey(1)}
+	ip, err := s.assignAddress(leased)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate fixes an address the pool leased to a client that is
+	// no longer connected: the lease is dropped and the address reserved
+	cert := &Client{SessionID: 2, PublicKey: testKey(2), user: &auth.User{Name: "dave", TunnelIP: ip, CertSerial: 1}}
+	if got, err := s.assignAddress(cert); err != nil || !got.Equal(ip) {
+		t.Fatalf("certificate: got %s, %v", got, err)
+	}
+	if _, ok := s.pool.lookup(leased.lease); ok {
+		t.Fatal("lease of the certificate address kept")
+	}
+	if other, err := s.assignAddress(leased); err != nil || other.Equal(ip) {
+		t.Fatalf("re-lease: got %s, %v", other, err)
+	}
+}
+
+func TestAssignAddressCertificateInUse(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), true)
+
+	leased := &Client{SessionID: 1, PublicKey: testKey(1)}
+	ip, err := s.assignAddress(leased)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased.TunnelIP = ip
+	s.addClientLocked(leased)
+
+	// A live session keeps its address
+	cert := &Client{SessionID: 2, PublicKey: testKey(2), user: &auth.User{Name: "dave", TunnelIP: ip, CertSerial: 1}}
+	if _, err := s.assignAddress(cert); !errors.Is(err, errAddressInUse) {
+		t.Fatalf("got %v, want errAddressInUse", err)
+	}
+	if owner := s.routes.lookup(ip); owner != leased {
+		t.Fatal("route to the leased address moved")
+	}
+}
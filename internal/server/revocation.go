@@ -0,0 +1,77 @@
+package server
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/nees/omail/internal/auth"
+	"github.com/nees/omail/internal/protocol"
+)
+
+// revocationPollInterval is how often the revocation list file is checked for changes
+const revocationPollInterval = 2 * time.Second
+
+// watchRevocations reloads the revocation list whenever its file changes and
+// tears down the sessions of clients whose credentials it revokes
+func (s *Server) watchRevocations() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(revocationPollInterval)
+	defer ticker.Stop()
+
+	lastMod, lastSize := fileVersion(s.revocationFile)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			mod, size := fileVersion(s.revocationFile)
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+
+			list, err := auth.LoadRevocationList(s.revocationFile)
+			if err != nil {
+				// Keep enforcing the last good list
+				log.Printf("Failed to reload revocation list: %v", err)
+				continue
+			}
+			s.revoked.Store(list)
+			log.Printf("Reloaded revocation list (%d entries)", list.Len())
+
+			s.revokeSessions(list)
+		}
+	}
+}
+
+// revokeSessions removes every session authenticated with a revoked credential
+func (s *Server) revokeSessions(list *auth.RevocationList) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	for sessionID, client := range s.clients {
+		if !list.Revoked(client.PublicKey, client.user) {
+			continue
+		}
+		s.sendControl(client, &protocol.SessionError{Code: protocol.ErrorCodeRevoked})
+		s.deleteClientLocked(client)
+		if client.Username != "" {
+			log.Printf("Client revoked: %s (session: %d, user: %s, key: %s)", client.endpoint(), sessionID, client.Username, client.PublicKey)
+		} else {
+			log.Printf("Client revoked: %s (session: %d, key: %s)", client.endpoint(), sessionID, client.PublicKey)
+		}
+	}
+}
+
+// fileVersion returns the modification time and size of a file, or zero
+// values if it cannot be read
+func fileVersion(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nees/omail/internal/auth"
+)
+
+func TestRevokeSessionsByUser(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	bob := addTestClient(s, 1, "10.0.0.2")
+	bob.user = &auth.User{Name: "bob"}
+	bob.Username = "bob"
+	alice := addTestClient(s, 2, "10.0.0.3")
+	alice.user = &auth.User{Name: "alice"}
+	alice.Username = "alice"
+
+	path := filepath.Join(t.TempDir(), "revoked.txt")
+	if err := os.WriteFile(path, []byte("user bob\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := auth.LoadRevocationList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.revokeSessions(list)
+
+	if _, ok := s.clients[bob.SessionID]; ok {
+		t.Fatal("session of the revoked user kept")
+	}
+	if _, ok := s.clients[alice.SessionID]; !ok {
+		t.Fatal("session of another user dropped")
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sort"
+
+	"github.com/nees/omail/internal/protocol"
+)
+
+// routeTable maps addresses inside the tunnel to the sessions that own them,
+// so that packets read from the TUN go to one client only. Host routes are
+// looked up directly; subnets by longest prefix. It is guarded by the
+// server's clientsMu.
+type routeTable struct {
+	hosts   map[string]*Client // Keyed by the 16-byte form of the address
+	subnets []subnetRoute      // Longest prefix first
+}
+
+type subnetRoute struct {
+	network *net.IPNet
+	ones    int
+	client  *Client
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{hosts: make(map[string]*Client)}
+}
+
+// add routes a network to a client, replacing any route a previous session
+// held for the same network. That session loses the network from its
+// routes as well, so it can no longer send from it either.
+func (t *routeTable) add(network *net.IPNet, client *Client) {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		key := string(network.IP.To16())
+		if prev := t.hosts[key]; prev != nil && prev != client {
+			prev.dropRoute(network)
+		}
+		t.hosts[key] = client
+		return
+	}
+
+	for i, r := range t.subnets {
+		if r.network.String() == network.String() {
+			if r.client != client {
+				r.client.dropRoute(network)
+			}
+			t.subnets[i].client = client
+			return
+		}
+	}
+	t.subnets = append(t.subnets, subnetRoute{network: network, ones: ones, client: client})
+	sort.SliceStable(t.subnets, func(i, j int) bool {
+		return t.subnets[i].ones > t.subnets[j].ones
+	})
+}
+
+// remove drops every route held by a client
+func (t *routeTable) remove(client *Client) {
+	for _, network := range client.routes {
+		if ones, bits := network.Mask.Size(); ones == bits {
+			key := string(network.IP.To16())
+			if t.hosts[key] == client {
+				delete(t.hosts, key)
+			}
+		}
+	}
+
+	subnets := t.subnets[:0]
+	for _, r := range t.subnets {
+		if r.client != client {
+			subnets = append(subnets, r)
+		}
+	}
+	t.subnets = subnets
+}
+
+// lookup returns the client that ip is routed to, or nil
+func (t *routeTable) lookup(ip net.IP) *Client {
+	if client, ok := t.hosts[string(ip.To16())]; ok {
+		return client
+	}
+	for _, r := range t.subnets {
+		if r.network.Contains(ip) {
+			return r.client
+		}
+	}
+	return nil
+}
+
+// dropRoute removes a network from the client's routes. The caller holds
+// clientsMu.
+func (c *Client) dropRoute(network *net.IPNet) {
+	routes := c.routes[:0]
+	for _, r := range c.routes {
+		if r.String() != network.String() {
+			routes = append(routes, r)
+		}
+	}
+	c.routes = routes
+}
+
+// hostNetwork returns the single-address network of ip
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// addClientLocked registers a session and routes its tunnel IP and its
+// user's subnets to it. The caller holds clientsMu.
+func (s *Server) addClientLocked(client *Client) {
+	if client.TunnelIP != nil {
+		client.routes = append(client.routes, hostNetwork(client.TunnelIP))
+	}
+	if client.user != nil {
+		client.routes = append(client.routes, client.user.Subnets...)
+	}
+
+	s.clients[client.SessionID] = client
+	for _, network := range client.routes {
+		s.routes.add(network, client)
+	}
+}
+
+// deleteClientLocked drops a session and its routes. The caller holds clientsMu.
+func (s *Server) deleteClientLocked(client *Client) {
+	delete(s.clients, client.SessionID)
+	s.routes.remove(client)
+}
+
+// dropLogLimit is how many packets of each kind of offence are logged per
+// session
+const dropLogLimit = 5
+
+// checkSource reports whether a packet from a client may enter the TUN: its
+// source address must be one the session's routes cover (cryptokey
+// routing), or one learnAddress can give the session. Other packets are
+// counted and the first offences logged. Link-local and multicast sources,
+// which client operating systems emit on their own, are dropped quietly.
+func (s *Server) checkSource(client *Client, packet []byte) bool {
+	src, err := protocol.SourceIP(packet)
+	if err != nil || src.IsUnspecified() || src.IsLinkLocalUnicast() || src.IsMulticast() {
+		return false
+	}
+
+	s.clientsMu.RLock()
+	allowed := client.owns(src)
+	s.clientsMu.RUnlock()
+	if allowed || s.learnAddress(client, src) {
+		return true
+	}
+
+	switch n := client.SpoofsDropped.Add(1); {
+	case n < dropLogLimit:
+		log.Printf("Dropped packet with spoofed source %s from client %s (session: %d)",
+			src, client.endpoint(), client.SessionID)
+	case n == dropLogLimit:
+		log.Printf("Dropped packet with spoofed source %s from client %s (session: %d); not logging further ones",
+			src, client.endpoint(), client.SessionID)
+	}
+	return false
+}
+
+// checkDestination reports whether a client's user may reach the
+// destination of a packet: if the user has allowed routes, one of them must
+// cover it. Other packets are counted and the first ones logged.
+func (s *Server) checkDestination(client *Client, packet []byte) bool {
+	if client.user == nil || len(client.user.AllowedRoutes) == 0 {
+		return true
+	}
+	dst, err := protocol.DestinationIP(packet)
+	if err != nil {
+		return false
+	}
+	for _, network := range client.user.AllowedRoutes {
+		if network.Contains(dst) {
+			return true
+		}
+	}
+
+	switch n := client.DeniedDropped.Add(1); {
+	case n < dropLogLimit:
+		log.Printf("Dropped packet to %s outside the allowed routes of client %s (session: %d)",
+			dst, client.endpoint(), client.SessionID)
+	case n == dropLogLimit:
+		log.Printf("Dropped packet to %s outside the allowed routes of client %s (session: %d); not logging further ones",
+			dst, client.endpoint(), client.SessionID)
+	}
+	return false
+}
+
+// owns reports whether one of the client's routes covers ip. The caller
+// holds clientsMu.
+func (c *Client) owns(ip net.IP) bool {
+	for _, network := range c.routes {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// learnAddress routes src to a client that sends its first packet without
+// the server having assigned it an address, as for allow-listed keys that
+// bring their own -tun-ip. Only a free address of the tunnel network can be
+// learned: not the server's own, not one reserved for a user or leased from
+// the pool, and not one routed to another session. It reports whether src
+// was learned.
+func (s *Server) learnAddress(client *Client, src net.IP) bool {
+	if client.TunnelIP != nil || client.learned.Load() {
+		return false
+	}
+	if !s.learnable(src) {
+		return false
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.clients[client.SessionID] != client || client.learned.Load() {
+		return false
+	}
+	if owner := s.routes.lookup(src); owner != nil && owner != client {
+		return false
+	}
+
+	network := hostNetwork(src)
+	client.routes = append(client.routes, network)
+	s.routes.add(network, client)
+	client.learned.Store(true)
+	log.Printf("Learned tunnel IP %s for client %d", network.IP, client.SessionID)
+	return true
+}
+
+// learnable reports whether a client may claim ip as its tunnel address by
+// sending from it
+func (s *Server) learnable(ip net.IP) bool {
+	if !s.tunNet.Contains(ip) || ip.Equal(s.tunIP) {
+		return false
+	}
+	if _, reserved := s.users.LookupIP(ip); reserved {
+		return false
+	}
+	return s.pool == nil || !s.pool.contains(ip)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/nees/omail/internal/auth"
+)
+
+// ipv4Packet returns a minimal IPv4 header from src to dst
+func ipv4Packet(src, dst string) []byte {
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	return packet
+}
+
+// addTestClient registers a session with a tunnel IP and subnets
+func addTestClient(s *Server, sessionID uint32, tunnelIP string, subnets ...*net.IPNet) *Client {
+	client := &Client{SessionID: sessionID, PublicKey: testKey(byte(sessionID))}
+	if tunnelIP != "" {
+		client.TunnelIP = net.ParseIP(tunnelIP).To4()
+	}
+	if len(subnets) > 0 {
+		client.user = &auth.User{Name: "user", Subnets: subnets}
+	}
+
+	s.clientsMu.Lock()
+	s.addClientLocked(client)
+	s.clientsMu.Unlock()
+	return client
+}
+
+func TestRouteTableLookup(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	a := addTestClient(s, 1, "10.0.0.2", mustParseCIDR(t, "192.168.0.0/16"))
+	b := addTestClient(s, 2, "10.0.0.3", mustParseCIDR(t, "192.168.10.0/24"))
+
+	tests := []struct {
+		ip   string
+		want *Client
+	}{
+		{"10.0.0.2", a},
+		{"10.0.0.3", b},
+		{"10.0.0.4", nil},
+		{"192.168.1.1", a},
+		{"192.168.10.1", b}, // Longest prefix wins
+		{"172.16.0.1", nil},
+	}
+	for _, tt := range tests {
+		if got := s.routes.lookup(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	s.clientsMu.Lock()
+	s.deleteClientLocked(b)
+	s.clientsMu.Unlock()
+	if got := s.routes.lookup(net.ParseIP("192.168.10.1")); got != a {
+		t.Errorf("after removal: got %v, want the covering subnet's client", got)
+	}
+	if got := s.routes.lookup(net.ParseIP("10.0.0.3")); got != nil {
+		t.Errorf("removed host route still resolves to %v", got)
+	}
+}
+
+func TestRouteTableTakeover(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	subnet := mustParseCIDR(t, "192.168.10.0/24")
+	old := addTestClient(s, 1, "10.0.0.2", subnet)
+	replacement := addTestClient(s, 2, "10.0.0.2", subnet)
+
+	for _, ip := range []string{"10.0.0.2", "192.168.10.1"} {
+		if got := s.routes.lookup(net.ParseIP(ip)); got != replacement {
+			t.Errorf("%s: got %v, want the new session", ip, got)
+		}
+		if old.owns(net.ParseIP(ip)) {
+			t.Errorf("old session still owns %s", ip)
+		}
+	}
+
+	// Dropping the old session leaves the new one's routes in place
+	s.clientsMu.Lock()
+	s.deleteClientLocked(old)
+	s.clientsMu.Unlock()
+	if got := s.routes.lookup(net.ParseIP("10.0.0.2")); got != replacement {
+		t.Errorf("after dropping the old session: got %v", got)
+	}
+}
+
+func TestLearnAddress(t *testing.T) {
+	users := auth.NewUserDB()
+	if err := users.Add(&auth.User{Name: "carol", TunnelIP: net.ParseIP("10.0.0.5")}); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, users, true)
+	taken := addTestClient(s, 1, "10.0.0.2")
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"server address", "10.0.0.1"},
+		{"another session's address", "10.0.0.2"},
+		{"user address", "10.0.0.5"},
+		{"pool address", "10.0.0.130"},
+		{"outside the tunnel network", "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := addTestClient(s, 2, "")
+			if s.learnAddress(client, net.ParseIP(tt.src).To4()) {
+				t.Fatalf("learned %s", tt.src)
+			}
+		})
+	}
+	if got := s.routes.lookup(net.ParseIP("10.0.0.2")); got != taken {
+		t.Fatal("route of another session moved")
+	}
+
+	// A free address is learned once; the session cannot add more
+	client := addTestClient(s, 3, "")
+	if !s.learnAddress(client, net.ParseIP("10.0.0.9").To4()) {
+		t.Fatal("free address not learned")
+	}
+	if got := s.routes.lookup(net.ParseIP("10.0.0.9")); got != client {
+		t.Fatalf("learned address routed to %v", got)
+	}
+	if s.learnAddress(client, net.ParseIP("10.0.0.10").To4()) {
+		t.Fatal("second address learned")
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	client := addTestClient(s, 1, "10.0.0.2", mustParseCIDR(t, "192.168.10.0/24"))
+	addTestClient(s, 2, "10.0.0.3")
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"10.0.0.2", true},
+		{"192.168.10.7", true},
+		{"10.0.0.3", false}, // Another session's address
+		{"10.0.0.9", false}, // Free, but the session has an address
+		{"8.8.8.8", false},
+		{"169.254.1.1", false},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := s.checkSource(client, ipv4Packet(tt.src, "10.0.0.1")); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	// Link-local and unspecified sources are dropped without counting
+	if got := client.SpoofsDropped.Load(); got != 3 {
+		t.Errorf("counted %d spoofed packets, want 3", got)
+	}
+
+	if s.checkSource(client, []byte{0x45, 0}) {
+		t.Error("truncated packet accepted")
+	}
+}
+
+func TestCheckSourceAfterTakeover(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	old := addTestClient(s, 1, "10.0.0.2")
+	addTestClient(s, 2, "10.0.0.2")
+
+	if s.checkSource(old, ipv4Packet("10.0.0.2", "10.0.0.1")) {
+		t.Fatal("old session may still send from a taken-over address")
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	s := testServer(t, auth.NewUserDB(), false)
+	client := addTestClient(s, 1, "10.0.0.2")
+
+	// Without allowed routes every destination may be reached
+	if !s.checkDestination(client, ipv4Packet("10.0.0.2", "8.8.8.8")) {
+		t.Fatal("packet of an unrestricted client dropped")
+	}
+
+	client.user = &auth.User{Name: "restricted", AllowedRoutes: []*net.IPNet{
+		mustParseCIDR(t, "10.0.0.1/32"),
+		mustParseCIDR(t, "192.168.10.0/24"),
+	}}
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"192.168.10.20", true},
+		{"10.0.0.3", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := s.checkDestination(client, ipv4Packet("10.0.0.2", tt.dst)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+	if got := client.DeniedDropped.Load(); got != 2 {
+		t.Errorf("counted %d denied packets, want 2", got)
+	}
+}
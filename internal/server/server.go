@@ -2,25 +2,62 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/ed25519"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nees/omail/internal/auth"
 	"github.com/nees/omail/internal/crypto"
 	"github.com/nees/omail/internal/protocol"
 	"github.com/nees/omail/internal/tun"
 )
 
+// DefaultHandshakeLoad is the number of handshake inits per second above
+// which the server requires clients to echo a cookie
+const DefaultHandshakeLoad = 100
+
 // Server represents a VPN server
 type Server struct {
 	address    string
-	crypto     *crypto.Crypto
-	tun        *tun.Interface
+	privateKey crypto.PrivateKey
+	peers      map[crypto.PublicKey]*peer
+	peersMu    sync.Mutex
+	users      *auth.UserDB
+	caKeys     []ed25519.PublicKey
+	// revocationFile is watched for changes; revoked holds its last good contents
+	revocationFile string
+	revoked        atomic.Pointer[auth.RevocationList]
+	// otpSteps holds the time step of the last one-time code accepted from
+	// each user, so that a code cannot be used twice
+	otpSteps map[string]uint64
+	otpMu    sync.Mutex
+	psks     map[crypto.PublicKey]crypto.PresharedKey
+	kexMode  crypto.KEXMode
+	suites   []crypto.CipherSuite
+	cookies  *crypto.CookieChecker
+	load     handshakeLoad
+	// passwords verifies user passwords off the read loop
+	passwords *passwordVerifier
+	// handshakeMu serializes the authorization of handshake inits, which
+	// the read loop and the password workers both complete
+	handshakeMu sync.Mutex
+	tun         *tun.Interface
+	tunIP       net.IP
+	tunMask     net.IPMask
+	tunNet      *net.IPNet // The tunnel network, derived from tunIP and tunMask
+	// pool leases tunnel IPs to clients without a fixed one; nil if disabled
+	pool *addressPool
+	// pushRoutes and pushDNS are pushed to clients with their tunnel IP
+	pushRoutes []*net.IPNet
+	pushDNS    []net.IP
 	clients    map[uint32]*Client
+	routes     *routeTable // Guarded by clientsMu
 	clientsMu  sync.RWMutex
 	udpConn    *net.UDPConn
 	ctx        context.Context
@@ -30,27 +67,133 @@ type Server struct {
 
 // Client represents a connected VPN client
 type Client struct {
-	SessionID   uint32
-	RemoteAddr  *net.UDPAddr
-	LastSeen    time.Time
-	mu          sync.Mutex
+	SessionID  uint32
+	PublicKey  crypto.PublicKey
+	Username   string       // Name of the user the session belongs to, if any
+	RemoteAddr *net.UDPAddr // Follows the client when it roams; guarded by mu
+	LastSeen   time.Time
+	TunnelIP   net.IP // Address assigned to the client, if any
+	// Capabilities are the protocol features both sides support
+	Capabilities protocol.Capabilities
+	user         *auth.User // nil for a key from the allow-list
+	lease        string     // Owner of the client's pool lease, if any
+	otpStep      uint64     // Time step of the one-time code that opened the session
+	routes       []*net.IPNet
+	learned      atomic.Bool // Whether an address was learned from its packets
+	keys         crypto.Keyring
+	mu           sync.Mutex
+
+	// ReplaysDropped counts packets rejected by the replay window
+	ReplaysDropped atomic.Uint64
+	// SpoofsDropped counts packets whose source address the session does
+	// not own
+	SpoofsDropped atomic.Uint64
+	// DeniedDropped counts packets to destinations outside the user's
+	// allowed routes
+	DeniedDropped atomic.Uint64
+}
+
+// peer holds the state kept for a client key across sessions
+type peer struct {
+	allowed       bool // Listed in the allow-list rather than admitted by password
+	lastTimestamp uint64
 }
 
 // Config holds server configuration
 type Config struct {
-	Address     string
-	Password    string
-	TUNName     string
-	TUNIP       string
-	TUNNetmask  string
-	MTU         int
+	Address    string
+	PrivateKey crypto.PrivateKey
+	Peers      []crypto.PublicKey // Allowed client public keys
+	// UsersFile is a JSON user database (see auth.LoadUsers) mapping user
+	// names to credentials, tunnel IPs and allowed routes
+	UsersFile string
+	// CAKeys are the CA public keys trusted to sign client certificates
+	CAKeys []ed25519.PublicKey
+	// RevocationFile lists revoked certificate serials, client keys and users
+	// (see auth.LoadRevocationList). The server watches it and drops
+	// sessions as soon as their credentials are revoked.
+	RevocationFile string
+	// Passwords maps further user names to PHC-encoded Argon2id password
+	// hashes. These users may connect with any key.
+	Passwords map[string]string
+	// PresharedKeys maps client public keys to the pre-shared keys mixed
+	// into their handshakes. Clients without one use the all-zero key.
+	PresharedKeys map[crypto.PublicKey]crypto.PresharedKey
+	// KEXMode selects whether handshakes add ML-KEM-768 to X25519.
+	// Defaults to crypto.KEXHybrid, which still accepts classic clients.
+	KEXMode crypto.KEXMode
+	// CipherSuites lists the transport cipher suites the server accepts, in
+	// order of preference. Defaults to crypto.DefaultSuites().
+	CipherSuites []crypto.CipherSuite
+	// HandshakeLoad is the number of handshake inits per second above which
+	// inits must carry a cookie. Defaults to DefaultHandshakeLoad.
+	HandshakeLoad int
+	// AddressPool is the network tunnel IPs are leased from to clients
+	// whose user has no fixed tunnel IP. Nil to disable.
+	AddressPool *net.IPNet
+	// LeaseFile keeps the address leases across restarts; empty to keep
+	// them in memory only
+	LeaseFile string
+	// LeaseTime is how long an address stays reserved for a client after
+	// its last session. Defaults to DefaultLeaseTime.
+	LeaseTime time.Duration
+	// PushRoutes are the networks clients route through the tunnel, unless
+	// their user has allowed routes; empty means all traffic
+	PushRoutes []*net.IPNet
+	// PushDNS are DNS servers clients use while connected
+	PushDNS    []net.IP
+	TUNName    string
+	TUNIP      string
+	TUNNetmask string
+	MTU        int
 }
 
 // NewServer creates a new VPN server
 func NewServer(config Config) (*Server, error) {
-	crypto, err := crypto.NewCrypto(config.Password)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create crypto: %w", err)
+	if config.PrivateKey == (crypto.PrivateKey{}) {
+		return nil, fmt.Errorf("private key is required")
+	}
+
+	users := auth.NewUserDB()
+	if config.UsersFile != "" {
+		var err error
+		users, err = auth.LoadUsers(config.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load users: %w", err)
+		}
+	}
+	for name, hash := range config.Passwords {
+		if err := users.Add(&auth.User{Name: name, PasswordHash: hash}); err != nil {
+			return nil, fmt.Errorf("failed to add password user: %w", err)
+		}
+	}
+
+	if len(config.Peers) == 0 && users.Len() == 0 && len(config.CAKeys) == 0 {
+		return nil, fmt.Errorf("at least one allowed peer key, user or CA is required")
+	}
+
+	peers := make(map[crypto.PublicKey]*peer, len(config.Peers))
+	for _, key := range config.Peers {
+		peers[key] = &peer{allowed: true}
+	}
+
+	suites := config.CipherSuites
+	if len(suites) == 0 {
+		suites = crypto.DefaultSuites()
+	}
+
+	loadLimit := config.HandshakeLoad
+	if loadLimit <= 0 {
+		loadLimit = DefaultHandshakeLoad
+	}
+
+	var revoked *auth.RevocationList
+	if config.RevocationFile != "" {
+		var err error
+		revoked, err = auth.LoadRevocationList(config.RevocationFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load revocation list: %w", err)
+		}
 	}
 
 	tunInterface, err := tun.New(config.TUNName, config.MTU)
@@ -61,9 +204,25 @@ func NewServer(config Config) (*Server, error) {
 	// Parse TUN IP and netmask
 	tunIP := net.ParseIP(config.TUNIP)
 	if tunIP == nil {
+		tunInterface.Close()
 		return nil, fmt.Errorf("invalid TUN IP: %s", config.TUNIP)
 	}
 
+	var pool *addressPool
+	if config.AddressPool != nil {
+		if config.LeaseTime != 0 && config.LeaseTime < minLeaseTime {
+			tunInterface.Close()
+			return nil, fmt.Errorf("lease time must be at least %s", minLeaseTime)
+		}
+		// Never lease the server's own address or one assigned to a user
+		reserved := append(users.TunnelIPs(), tunIP)
+		pool, err = newAddressPool(config.AddressPool, reserved, config.LeaseTime, config.LeaseFile)
+		if err != nil {
+			tunInterface.Close()
+			return nil, fmt.Errorf("failed to create address pool: %w", err)
+		}
+	}
+
 	var mask net.IPMask
 	if config.TUNNetmask != "" {
 		mask = net.IPMask(net.ParseIP(config.TUNNetmask).To4())
@@ -82,17 +241,43 @@ func NewServer(config Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to bring TUN up: %w", err)
 	}
 
+	passwords, err := newPasswordVerifier()
+	if err != nil {
+		tunInterface.Close()
+		return nil, fmt.Errorf("failed to create password verifier: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Server{
-		address: config.Address,
-		crypto:  crypto,
-		tun:     tunInterface,
-		clients: make(map[uint32]*Client),
-		ctx:     ctx,
-		cancel:  cancel,
+		address:        config.Address,
+		privateKey:     config.PrivateKey,
+		peers:          peers,
+		users:          users,
+		caKeys:         config.CAKeys,
+		revocationFile: config.RevocationFile,
+		otpSteps:       make(map[string]uint64),
+		psks:           config.PresharedKeys,
+		kexMode:        config.KEXMode,
+		suites:         suites,
+		cookies:        crypto.NewCookieChecker(config.PrivateKey.PublicKey()),
+		load:           handshakeLoad{limit: loadLimit},
+		passwords:      passwords,
+		tun:            tunInterface,
+		tunIP:          tunIP,
+		tunMask:        mask,
+		tunNet:         &net.IPNet{IP: tunIP.Mask(mask), Mask: mask},
+		pool:           pool,
+		pushRoutes:     config.PushRoutes,
+		pushDNS:        config.PushDNS,
+		clients:        make(map[uint32]*Client),
+		routes:         newRouteTable(),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 
+	s.revoked.Store(revoked)
+
 	return s, nil
 }
 
@@ -111,6 +296,7 @@ func (s *Server) Start() error {
 	s.udpConn = conn
 
 	log.Printf("VPN Server listening on %s", s.address)
+	log.Printf("Server public key: %s", s.privateKey.PublicKey())
 	log.Printf("TUN interface: %s", s.tun.Name())
 
 	// Start reading from TUN
@@ -121,26 +307,48 @@ func (s *Server) Start() error {
 	s.wg.Add(1)
 	go s.readFromUDP()
 
+	// Start verifying passwords
+	for range passwordWorkers {
+		s.wg.Add(1)
+		go s.verifyPasswords()
+	}
+
 	// Start client cleanup goroutine
 	s.wg.Add(1)
 	go s.cleanupClients()
 
+	// Start watching the revocation list
+	if s.revocationFile != "" {
+		s.wg.Add(1)
+		go s.watchRevocations()
+	}
+
 	return nil
 }
 
 // Stop stops the VPN server
 func (s *Server) Stop() error {
+	// Tell clients the session is over rather than let them time out
+	if s.udpConn != nil {
+		s.clientsMu.RLock()
+		for _, client := range s.clients {
+			s.sendControl(client, &protocol.Disconnect{Reason: "server shutting down"})
+		}
+		s.clientsMu.RUnlock()
+	}
+
 	s.cancel()
-	
+	s.renewLeases()
+
 	if s.udpConn != nil {
 		s.udpConn.Close()
 	}
-	
+
 	if s.tun != nil {
 		s.tun.Down()
 		s.tun.Close()
 	}
-	
+
 	s.wg.Wait()
 	return nil
 }
@@ -148,9 +356,9 @@ func (s *Server) Stop() error {
 // readFromTUN reads packets from TUN and forwards them to clients
 func (s *Server) readFromTUN() {
 	defer s.wg.Done()
-	
+
 	buf := make([]byte, 65535)
-	
+
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -163,15 +371,19 @@ func (s *Server) readFromTUN() {
 			}
 
 			packet := buf[:n]
-			
-			// Determine which client to send to based on destination IP
-			// For simplicity, we'll broadcast to all clients
-			// In production, you'd want to maintain a routing table
+
+			dst, err := protocol.DestinationIP(packet)
+			if err != nil {
+				continue
+			}
+
+			// Packets for addresses no session owns are dropped
 			s.clientsMu.RLock()
-			for _, client := range s.clients {
+			client := s.routes.lookup(dst)
+			s.clientsMu.RUnlock()
+			if client != nil {
 				s.sendToClient(client, packet)
 			}
-			s.clientsMu.RUnlock()
 		}
 	}
 }
@@ -179,9 +391,9 @@ func (s *Server) readFromTUN() {
 // readFromUDP reads packets from UDP and forwards them to TUN
 func (s *Server) readFromUDP() {
 	defer s.wg.Done()
-	
+
 	buf := make([]byte, 65535)
-	
+
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -193,112 +405,746 @@ func (s *Server) readFromUDP() {
 				continue
 			}
 
-			// Decrypt packet
-			encrypted := buf[:n]
-			decrypted, err := s.crypto.Decrypt(encrypted)
+			// Decode protocol packet
+			pkt, err := protocol.Decode(buf[:n])
 			if err != nil {
-				log.Printf("Failed to decrypt packet from %s: %v", clientAddr, err)
+				log.Printf("Failed to decode packet from %s: %v", clientAddr, err)
 				continue
 			}
 
-			// Decode protocol packet
-			pkt, err := protocol.Decode(decrypted)
-			if err != nil {
-				log.Printf("Failed to decode packet: %v", err)
-				continue
+			switch pkt.Header.Type {
+			case protocol.PacketTypeHandshakeInit:
+				s.handleHandshakeInit(pkt, clientAddr)
+			case protocol.PacketTypeKeepAlive:
+				s.handleKeepAlive(pkt, clientAddr)
+			case protocol.PacketTypeData:
+				s.handleDataPacket(pkt, clientAddr)
+			case protocol.PacketTypeControl:
+				s.handleControl(pkt, clientAddr)
+			case protocol.PacketTypePing:
+				s.handlePing(pkt, clientAddr)
 			}
+		}
+	}
+}
 
-			// Handle keep-alive
-			if pkt.Header.Type == protocol.PacketTypeKeepAlive {
-				s.handleKeepAlive(pkt.Header.SessionID, clientAddr)
-				continue
+// handlePing answers a client probing the server's endpoints. The pong is
+// smaller than the ping, so it cannot amplify a spoofed flood.
+func (s *Server) handlePing(pkt *protocol.Packet, addr *net.UDPAddr) {
+	if len(pkt.Data) != protocol.PingNonceSize+2*crypto.MACSize || !s.cookies.CheckMAC1(pkt.Data) {
+		return
+	}
+
+	pong := protocol.NewPongPacket(pkt.Data[:protocol.PingNonceSize])
+	if _, err := s.udpConn.WriteToUDP(pong.Encode(), addr); err != nil {
+		log.Printf("Error sending pong to %s: %v", addr, err)
+	}
+}
+
+// handleHandshakeInit authenticates a handshake init and establishes a session
+func (s *Server) handleHandshakeInit(pkt *protocol.Packet, addr *net.UDPAddr) {
+	// Inits from senders that do not know our public key are dropped
+	// before any Diffie-Hellman work
+	if !s.cookies.CheckMAC1(pkt.Data) {
+		return
+	}
+
+	// Under load only senders that proved they own their address get a
+	// handshake; everyone else is sent a cookie to retry with
+	if s.load.add() && !s.cookies.CheckMAC2(pkt.Data, addrBytes(addr)) {
+		s.sendCookieReply(pkt, addr)
+		return
+	}
+
+	body, _, _, _ := crypto.SplitMACs(pkt.Data)
+	hello, msg, err := protocol.DecodeHello(body)
+	if err != nil {
+		log.Printf("Invalid handshake from %s: %v", addr, err)
+		return
+	}
+
+	// Refuse incompatible clients with an explicit reject rather than a
+	// handshake they cannot decode
+	if reject, ok := s.checkHello(hello); !ok {
+		log.Printf("Rejected handshake from %s: client speaks protocol version %d with capabilities %s",
+			addr, hello.Version, hello.Capabilities)
+		s.sendReject(pkt, addr, reject)
+		return
+	}
+
+	hs, err := crypto.NewResponder(s.privateKey, body[:protocol.HelloSize])
+	if err != nil {
+		log.Printf("Failed to create handshake: %v", err)
+		return
+	}
+
+	data, err := hs.ConsumeInit(msg)
+	if err != nil {
+		log.Printf("Handshake from %s failed: %v", addr, err)
+		return
+	}
+
+	publicKey := hs.PeerStatic()
+	payload, err := protocol.DecodeInitPayload(data)
+	if err != nil {
+		log.Printf("Invalid handshake payload from %s: %v", addr, err)
+		return
+	}
+
+	s.clientsMu.RLock()
+	existing := s.clients[pkt.Header.SessionID]
+	s.clientsMu.RUnlock()
+	if existing != nil && existing.PublicKey != publicKey {
+		existing = nil
+	}
+
+	init := &pendingInit{
+		pkt:       pkt,
+		addr:      addr,
+		hello:     hello,
+		hs:        hs,
+		publicKey: publicKey,
+		payload:   payload,
+		proven:    s.provenSession(publicKey, existing, pkt, msg, payload.RekeyProof),
+	}
+
+	// Rekeys, and reconnects replacing a session the server still holds,
+	// that prove they hold the keys of a session the user opened do not
+	// verify the password again. Other password handshakes wait for a
+	// verification worker.
+	certificate := len(payload.Certificate) > 0 && len(s.caKeys) > 0
+	if payload.Username == "" || certificate || (init.proven != nil && init.proven.Username == payload.Username) {
+		init.passwordOK = init.proven != nil
+		s.handshakeMu.Lock()
+		defer s.handshakeMu.Unlock()
+		s.acceptInit(init)
+		return
+	}
+
+	var hash string
+	if user, ok := s.users.Lookup(payload.Username); ok {
+		hash = user.PasswordHash
+	}
+	queued := s.passwords.submit(addr.IP, func() {
+		init.passwordOK = s.passwords.verify(hash, payload.Password)
+		s.handshakeMu.Lock()
+		defer s.handshakeMu.Unlock()
+		s.acceptInit(init)
+	})
+	if !queued {
+		log.Printf("Dropped handshake from %s: too many password verifications pending", addr)
+	}
+}
+
+// pendingInit is a handshake init decoded on the read loop, waiting to be
+// authorized and answered
+type pendingInit struct {
+	pkt       *protocol.Packet
+	addr      *net.UDPAddr
+	hello     protocol.Hello
+	hs        *crypto.Handshake
+	publicKey crypto.PublicKey
+	payload   *protocol.InitPayload
+	// proven is the session whose keys the init proved it holds, or nil
+	proven *Client
+	// passwordOK is set when the init's user name and password were
+	// verified, or the init proved a session of that user
+	passwordOK bool
+}
+
+// acceptInit authorizes a decoded handshake init and answers it, opening or
+// rekeying a session. The caller holds handshakeMu.
+func (s *Server) acceptInit(init *pendingInit) {
+	pkt, addr, hs, publicKey, payload, proven := init.pkt, init.addr, init.hs, init.publicKey, init.payload, init.proven
+
+	user, err := s.authorize(publicKey, payload, init.passwordOK)
+	if err != nil {
+		log.Printf("Rejected handshake from %s (key %s): %v", addr, publicKey, err)
+		return
+	}
+
+	sessionID := pkt.Header.SessionID
+	s.clientsMu.RLock()
+	existing, exists := s.clients[sessionID]
+	s.clientsMu.RUnlock()
+	if exists && existing.PublicKey != publicKey {
+		log.Printf("Rejected handshake from %s: session %d belongs to another key", addr, sessionID)
+		return
+	}
+
+	offered := make([]crypto.SuiteID, len(payload.CipherSuites))
+	for i, id := range payload.CipherSuites {
+		offered[i] = crypto.SuiteID(id)
+	}
+	suite, ok := crypto.NegotiateSuite(s.suites, offered)
+	if !ok {
+		log.Printf("Rejected handshake from %s (key %s): no common cipher suite", addr, publicKey)
+		return
+	}
+
+	// A client configured with a different pre-shared key cannot
+	// decrypt the response and never confirms the session
+	hs.SetPresharedKey(s.psks[publicKey])
+
+	// Users with a second factor give a one-time code when they open a
+	// session. Rekeys of the session they opened, and reconnects replacing
+	// it while the server still holds it, prove instead that they hold its
+	// keys: the static key alone must not take the session over. A lost
+	// response is retried with the code that opened the session.
+	var otpStep uint64
+	if proven != nil {
+		otpStep = proven.otpStep
+	}
+	if user != nil && user.RequiresOTP() && proven == nil {
+		var resumeStep uint64
+		if exists {
+			resumeStep = existing.otpStep
+		}
+		var authErr protocol.AuthError
+		if otpStep, authErr = s.checkOTP(user, payload.OTP, resumeStep); authErr != 0 {
+			if authErr == protocol.AuthErrorOTPRequired {
+				log.Printf("Asking %s (user %s) for a one-time code", addr, user.Name)
+			} else {
+				log.Printf("Rejected handshake from %s (user %s): %s", addr, user.Name, authErr)
+			}
+			s.refuseSession(hs, pkt, addr, authErr)
+			return
+		}
+	}
+
+	responsePayload := &protocol.ResponsePayload{
+		CipherSuite:  uint8(suite.ID()),
+		Capabilities: s.capabilities(),
+	}
+	kex := crypto.KEXNameClassic
+	switch {
+	case len(payload.KEMPublicKey) > 0 && s.kexMode != crypto.KEXClassic:
+		responsePayload.KEMCiphertext, err = hs.Encapsulate(payload.KEMPublicKey)
+		if err != nil {
+			log.Printf("Rejected handshake from %s (key %s): %v", addr, publicKey, err)
+			return
+		}
+		kex = crypto.KEXNameHybrid
+	case s.kexMode == crypto.KEXHybridOnly:
+		log.Printf("Rejected handshake from %s (key %s): client does not support hybrid key exchange", addr, publicKey)
+		return
+	}
+
+	response, err := hs.CreateResponse(responsePayload.Encode())
+	if err != nil {
+		log.Printf("Failed to create handshake response: %v", err)
+		return
+	}
+	keys, err := hs.Split()
+	if err != nil {
+		log.Printf("Failed to derive session keys: %v", err)
+		return
+	}
+
+	session, err := crypto.NewSession(keys, pkt.Header.KeyEpoch, suite)
+	if err != nil {
+		log.Printf("Failed to create session crypto: %v", err)
+		return
+	}
+
+	var client *Client
+	if exists {
+		if current := existing.keys.Current(); current != nil && current.Epoch == session.Epoch {
+			// The client never received our earlier response for this
+			// epoch and retried, so it cannot hold the old keys
+			existing.keys.Install(session)
+			log.Printf("Client re-established session: %s (session: %d)", addr, sessionID)
+		} else {
+			// Rekey: keep sending with the current keys until the client
+			// confirms the new ones by using them
+			existing.keys.SetNext(session)
+			log.Printf("Client rekeyed: %s (session: %d, epoch: %d)", addr, sessionID, session.Epoch)
+		}
+	} else {
+		if proven != nil {
+			log.Printf("Client %s resumes session %d (session: %d)", addr, proven.SessionID, sessionID)
+		}
+		client = &Client{
+			SessionID:    sessionID,
+			PublicKey:    publicKey,
+			user:         user,
+			RemoteAddr:   addr,
+			LastSeen:     time.Now(),
+			Capabilities: init.hello.Capabilities & s.capabilities(),
+			otpStep:      otpStep,
+		}
+		client.keys.Install(session)
+
+		if client.TunnelIP, err = s.assignAddress(client); err != nil {
+			// The client holds the keys now, so tell it why over the session
+			// instead of leaving it to time out
+			log.Printf("No tunnel address for client %s (key: %s): %v", addr, publicKey, err)
+			reply := protocol.NewHandshakeResponsePacket(sessionID, session.Epoch, response)
+			if _, err := s.udpConn.WriteToUDP(reply.Encode(), addr); err != nil {
+				log.Printf("Error sending handshake response to %s: %v", addr, err)
 			}
+			s.sendControl(client, &protocol.SessionError{Code: protocol.ErrorCodeNoAddress})
+			return
+		}
 
-			// Handle data packet
-			if pkt.Header.Type == protocol.PacketTypeData {
-				s.handleDataPacket(pkt, clientAddr)
+		s.clientsMu.Lock()
+		// A client key holds at most one session; drop any older one
+		for _, other := range s.clients {
+			if other.PublicKey == publicKey {
+				s.sendControl(other, &protocol.SessionError{Code: protocol.ErrorCodeSessionReplaced})
+				s.deleteClientLocked(other)
 			}
 		}
+		s.addClientLocked(client)
+		s.clientsMu.Unlock()
+
+		if user != nil {
+			client.Username = user.Name
+			log.Printf("New client connected: %s (session: %d, user: %s, key: %s, ip: %s, cipher: %s, kex: %s)",
+				addr, sessionID, user.Name, publicKey, client.TunnelIP, suite.Name(), kex)
+		} else {
+			log.Printf("New client connected: %s (session: %d, key: %s, ip: %s, cipher: %s, kex: %s)",
+				addr, sessionID, publicKey, client.TunnelIP, suite.Name(), kex)
+		}
+	}
+
+	reply := protocol.NewHandshakeResponsePacket(sessionID, session.Epoch, response)
+	if _, err := s.udpConn.WriteToUDP(reply.Encode(), addr); err != nil {
+		log.Printf("Error sending handshake response to %s: %v", addr, err)
+	}
+
+	// A new client configures its tunnel from the push; a lost push is
+	// requested again
+	if client != nil && client.Capabilities.Has(protocol.CapConfigPush) {
+		s.sendControl(client, s.tunnelConfig(client))
 	}
 }
 
-// handleKeepAlive handles keep-alive packets
-func (s *Server) handleKeepAlive(sessionID uint32, addr *net.UDPAddr) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
+// capabilities returns the protocol features the server supports
+func (s *Server) capabilities() protocol.Capabilities {
+	caps := protocol.CapCipherSuites | protocol.CapAuthErrors | protocol.CapConfigPush | protocol.CapKeepAlive
+	if s.kexMode != crypto.KEXClassic {
+		caps |= protocol.CapHybridKEX
+	}
+	return caps
+}
 
-	client, exists := s.clients[sessionID]
-	if !exists {
-		// Create new client
-		client = &Client{
-			SessionID:  sessionID,
-			RemoteAddr: addr,
-			LastSeen:   time.Now(),
+// checkHello decides whether the server can talk to a client with the given
+// protocol version and capabilities
+func (s *Server) checkHello(hello protocol.Hello) (protocol.Reject, bool) {
+	if hello.Version < protocol.MinVersion || hello.Version > protocol.Version {
+		return protocol.Reject{Reason: protocol.RejectVersion, Version: protocol.Version}, false
+	}
+
+	var required protocol.Capabilities
+	if s.kexMode == crypto.KEXHybridOnly {
+		required |= protocol.CapHybridKEX
+	}
+	if !hello.Capabilities.Has(required) {
+		return protocol.Reject{Reason: protocol.RejectCapabilities, Version: protocol.Version, Capabilities: required}, false
+	}
+	return protocol.Reject{}, true
+}
+
+// sendReject answers a handshake init from an incompatible client
+func (s *Server) sendReject(pkt *protocol.Packet, addr *net.UDPAddr, reject protocol.Reject) {
+	reply := protocol.NewRejectPacket(pkt.Header.SessionID, pkt.Header.KeyEpoch, reject)
+	if _, err := s.udpConn.WriteToUDP(reply.Encode(), addr); err != nil {
+		log.Printf("Error sending reject to %s: %v", addr, err)
+	}
+}
+
+// refuseSession answers a handshake init with a response carrying only an
+// authentication error. The client can verify that it came from the
+// server, but no session keys are derived from it.
+func (s *Server) refuseSession(hs *crypto.Handshake, pkt *protocol.Packet, addr *net.UDPAddr, authErr protocol.AuthError) {
+	payload := &protocol.ResponsePayload{AuthError: authErr}
+	response, err := hs.CreateResponse(payload.Encode())
+	if err != nil {
+		log.Printf("Failed to create handshake response: %v", err)
+		return
+	}
+
+	reply := protocol.NewHandshakeResponsePacket(pkt.Header.SessionID, pkt.Header.KeyEpoch, response)
+	if _, err := s.udpConn.WriteToUDP(reply.Encode(), addr); err != nil {
+		log.Printf("Error sending handshake response to %s: %v", addr, err)
+	}
+}
+
+// checkOTP verifies a user's one-time code and returns its time step. Each
+// code is accepted only once, except that the code from resumeStep, which
+// opened the session being set up again, may be repeated.
+func (s *Server) checkOTP(user *auth.User, code string, resumeStep uint64) (uint64, protocol.AuthError) {
+	if code == "" {
+		return 0, protocol.AuthErrorOTPRequired
+	}
+
+	step, ok := auth.VerifyTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return 0, protocol.AuthErrorOTPInvalid
+	}
+	if step == resumeStep {
+		return step, 0
+	}
+
+	s.otpMu.Lock()
+	defer s.otpMu.Unlock()
+	if last, used := s.otpSteps[user.Name]; used && step <= last {
+		return 0, protocol.AuthErrorOTPInvalid
+	}
+	s.otpSteps[user.Name] = step
+	return step, 0
+}
+
+// provenSession returns the session of the same client key whose keys
+// sealed the proof in a handshake init for this very handshake, or nil. An
+// init for an existing session can only prove that session.
+func (s *Server) provenSession(key crypto.PublicKey, existing *Client, pkt *protocol.Packet, msg []byte, proof *protocol.RekeyProof) *Client {
+	if proof == nil {
+		return nil
+	}
+
+	s.clientsMu.RLock()
+	client := s.clients[proof.SessionID]
+	s.clientsMu.RUnlock()
+	if client == nil || client.PublicKey != key || (existing != nil && client != existing) {
+		return nil
+	}
+
+	session := client.keys.Lookup(proof.KeyEpoch)
+	if session == nil {
+		return nil
+	}
+	ephemeral := msg[:crypto.PublicKeySize]
+	ad := protocol.RekeyProofAD(pkt.Header.SessionID, pkt.Header.KeyEpoch, ephemeral)
+	if _, err := session.Open(proof.Counter, proof.Tag, ad); err != nil {
+		return nil
+	}
+	return client
+}
+
+// sendCookieReply answers a handshake init with a cookie bound to its source address
+func (s *Server) sendCookieReply(pkt *protocol.Packet, addr *net.UDPAddr) {
+	data, err := s.cookies.CreateReply(pkt.Data, addrBytes(addr))
+	if err != nil {
+		log.Printf("Failed to create cookie reply: %v", err)
+		return
+	}
+
+	reply := protocol.NewCookieReplyPacket(pkt.Header.SessionID, pkt.Header.KeyEpoch, data)
+	if _, err := s.udpConn.WriteToUDP(reply.Encode(), addr); err != nil {
+		log.Printf("Error sending cookie reply to %s: %v", addr, err)
+	}
+}
+
+// authorize decides whether a client may connect and returns the user the
+// session belongs to, or nil for a key from the allow-list. The handshake
+// timestamp must also be newer than any seen before for the key, rejecting
+// replayed init messages.
+func (s *Server) authorize(key crypto.PublicKey, payload *protocol.InitPayload, passwordOK bool) (*auth.User, error) {
+	s.peersMu.Lock()
+	p, known := s.peers[key]
+	if known && payload.Timestamp <= p.lastTimestamp {
+		s.peersMu.Unlock()
+		return nil, fmt.Errorf("replayed handshake")
+	}
+	s.peersMu.Unlock()
+
+	user, err := s.identify(key, payload, known && p.allowed, passwordOK)
+	if err != nil {
+		return nil, err
+	}
+	if s.revoked.Load().Revoked(key, user) {
+		return nil, fmt.Errorf("credentials have been revoked")
+	}
+
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+
+	p, known = s.peers[key]
+	if !known {
+		p = &peer{}
+		s.peers[key] = p
+	}
+	if payload.Timestamp <= p.lastTimestamp {
+		return nil, fmt.Errorf("replayed handshake")
+	}
+	p.lastTimestamp = payload.Timestamp
+	return user, nil
+}
+
+// identify authenticates a client. A client with a certificate is
+// identified by it when the server trusts a CA. A client that names a user
+// must have presented that user's password, as passwordOK tells, and, if
+// the user has registered keys, use one of them. Otherwise the key itself
+// must belong to a user or be in the allow-list.
+func (s *Server) identify(key crypto.PublicKey, payload *protocol.InitPayload, allowed, passwordOK bool) (*auth.User, error) {
+	if len(payload.Certificate) > 0 && len(s.caKeys) > 0 {
+		return s.identifyCertificate(key, payload.Certificate)
+	}
+
+	if payload.Username != "" {
+		user, ok := s.users.Lookup(payload.Username)
+		if !ok || !passwordOK {
+			return nil, fmt.Errorf("invalid user name or password")
 		}
-		s.clients[sessionID] = client
-		log.Printf("New client connected: %s (session: %d)", addr, sessionID)
-	} else {
-		client.mu.Lock()
-		client.LastSeen = time.Now()
-		client.mu.Unlock()
+
+		if len(user.PublicKeys) > 0 && !user.HasKey(key) {
+			return nil, fmt.Errorf("key is not registered to user %s", user.Name)
+		}
+		if user.Disabled {
+			return nil, fmt.Errorf("user %s is disabled", user.Name)
+		}
+		return user, nil
+	}
+
+	if user, ok := s.users.LookupKey(key); ok {
+		if user.Disabled {
+			return nil, fmt.Errorf("user %s is disabled", user.Name)
+		}
+		return user, nil
 	}
+
+	if !allowed {
+		return nil, fmt.Errorf("unknown client key")
+	}
+	return nil, nil
 }
 
-// handleDataPacket handles data packets from clients
-func (s *Server) handleDataPacket(pkt *protocol.Packet, addr *net.UDPAddr) {
-	// Update client last seen
-	s.clientsMu.Lock()
+// identifyCertificate verifies a client certificate against the trusted CAs
+// and the client's static key. A user of the same name in the user database
+// can still be disabled to lock the certificate out, or be given a second
+// factor.
+func (s *Server) identifyCertificate(key crypto.PublicKey, data []byte) (*auth.User, error) {
+	cert, err := auth.ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := cert.Verify(s.caKeys, key, time.Now()); err != nil {
+		return nil, fmt.Errorf("certificate %s (serial %d): %w", cert.Name, cert.Serial, err)
+	}
+
+	certUser := cert.User()
+	if user, ok := s.users.Lookup(cert.Name); ok {
+		if user.Disabled {
+			return nil, fmt.Errorf("user %s is disabled", user.Name)
+		}
+		certUser.TOTPSecret = user.TOTPSecret
+		certUser.Subnets = user.Subnets
+	}
+	return certUser, nil
+}
+
+// authenticate looks up the session of a transport packet and decrypts its
+// payload. Packets for unknown sessions or key epochs, truncated packets and
+// replayed counters are rejected from the cleartext header alone, before
+// any cryptographic work is done.
+func (s *Server) authenticate(pkt *protocol.Packet, addr *net.UDPAddr) (*Client, []byte, bool) {
+	s.clientsMu.RLock()
 	client, exists := s.clients[pkt.Header.SessionID]
+	s.clientsMu.RUnlock()
 	if !exists {
-		client = &Client{
-			SessionID:  pkt.Header.SessionID,
-			RemoteAddr: addr,
-			LastSeen:   time.Now(),
-		}
-		s.clients[pkt.Header.SessionID] = client
-		log.Printf("New client connected: %s (session: %d)", addr, pkt.Header.SessionID)
-	} else {
-		client.mu.Lock()
-		client.LastSeen = time.Now()
-		client.mu.Unlock()
+		return nil, nil, false
+	}
+
+	session := client.keys.Lookup(pkt.Header.KeyEpoch)
+	if session == nil || len(pkt.Data) < session.Overhead() {
+		return nil, nil, false
+	}
+
+	if !session.Check(pkt.Header.Counter) {
+		client.ReplaysDropped.Add(1)
+		return nil, nil, false
+	}
+
+	payload, err := session.Open(pkt.Header.Counter, pkt.Data, pkt.Header.Encode())
+	if errors.Is(err, crypto.ErrReplay) {
+		client.ReplaysDropped.Add(1)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to decrypt packet from %s: %v", addr, err)
+		return nil, nil, false
+	}
+
+	// The first packet under a new epoch confirms the rekey
+	client.keys.Confirm(session)
+
+	// Only a packet that decrypted and passed the replay check may move the
+	// session, so neither a forged nor a replayed packet can redirect it
+	client.mu.Lock()
+	client.LastSeen = time.Now()
+	oldAddr := client.RemoteAddr
+	roamed := !addrEqual(oldAddr, addr)
+	if roamed {
+		client.RemoteAddr = addr
+	}
+	client.mu.Unlock()
+
+	if roamed {
+		log.Printf("Client roamed: %s -> %s (session: %d)", oldAddr, addr, client.SessionID)
+	}
+
+	return client, payload, true
+}
+
+// addrEqual reports whether two UDP addresses are the same endpoint
+func addrEqual(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+// endpoint returns the address the client's packets last came from
+func (c *Client) endpoint() *net.UDPAddr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.RemoteAddr
+}
+
+// handleKeepAlive handles keep-alive packets, answering them for clients
+// that watch for a dead server
+func (s *Server) handleKeepAlive(pkt *protocol.Packet, addr *net.UDPAddr) {
+	client, _, ok := s.authenticate(pkt, addr)
+	if !ok || !client.Capabilities.Has(protocol.CapKeepAlive) {
+		return
+	}
+	if _, err := s.sendPacket(client, protocol.PacketTypeKeepAlive, nil); err != nil &&
+		!errors.Is(err, crypto.ErrKeyExpired) && !errors.Is(err, crypto.ErrCounterExhausted) {
+		log.Printf("Error sending keep-alive to client %d: %v", client.SessionID, err)
+	}
+}
+
+// handleDataPacket handles data packets from clients
+func (s *Server) handleDataPacket(pkt *protocol.Packet, addr *net.UDPAddr) {
+	client, payload, ok := s.authenticate(pkt, addr)
+	if !ok {
+		return
+	}
+
+	if !s.checkSource(client, payload) || !s.checkDestination(client, payload) {
+		return
 	}
-	s.clientsMu.Unlock()
 
 	// Write packet data to TUN
-	if _, err := s.tun.Write(pkt.Data); err != nil {
+	if _, err := s.tun.Write(payload); err != nil {
 		log.Printf("Error writing to TUN: %v", err)
 	}
 }
 
+// handleControl handles control messages from clients
+func (s *Server) handleControl(pkt *protocol.Packet, addr *net.UDPAddr) {
+	client, payload, ok := s.authenticate(pkt, addr)
+	if !ok {
+		return
+	}
+
+	msg, err := protocol.DecodeControl(payload)
+	if err != nil {
+		log.Printf("Invalid control message from %s: %v", addr, err)
+		return
+	}
+
+	switch msg := msg.(type) {
+	case *protocol.Disconnect:
+		s.removeClient(client)
+		log.Printf("Client disconnected: %s (session: %d, replays dropped: %d, spoofs dropped: %d, denied dropped: %d)",
+			addr, client.SessionID, client.ReplaysDropped.Load(), client.SpoofsDropped.Load(), client.DeniedDropped.Load())
+	case *protocol.SessionError:
+		s.removeClient(client)
+		log.Printf("Client ended session: %s (session: %d): %v", addr, client.SessionID, msg)
+	case *protocol.ConfigRequest:
+		s.sendControl(client, s.tunnelConfig(client))
+	}
+}
+
+// tunnelConfig returns the configuration pushed to a client: its user's
+// tunnel IP, and the user's allowed routes or else the server's push routes
+func (s *Server) tunnelConfig(client *Client) *protocol.ConfigPush {
+	config := &protocol.ConfigPush{
+		Netmask:  s.tunMask,
+		Routes:   s.pushRoutes,
+		DNS:      s.pushDNS,
+		MTU:      uint16(s.tun.MTU()),
+		TunnelIP: client.TunnelIP,
+	}
+	if client.user != nil {
+		if len(client.user.AllowedRoutes) > 0 {
+			config.Routes = client.user.AllowedRoutes
+		}
+	}
+	return config
+}
+
+// removeClient removes a client's session
+func (s *Server) removeClient(client *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.clients[client.SessionID] == client {
+		s.deleteClientLocked(client)
+	}
+}
+
+// sendControl sends a control message to a client
+func (s *Server) sendControl(client *Client, msg protocol.ControlMessage) {
+	if _, err := s.sendPacket(client, protocol.PacketTypeControl, protocol.EncodeControl(msg)); err != nil &&
+		!errors.Is(err, crypto.ErrKeyExpired) && !errors.Is(err, crypto.ErrCounterExhausted) {
+		log.Printf("Error sending control message to client %d: %v", client.SessionID, err)
+	}
+}
+
 // sendToClient sends a packet to a client
 func (s *Server) sendToClient(client *Client, data []byte) {
-	client.mu.Lock()
-	addr := client.RemoteAddr
-	client.mu.Unlock()
-
-	// Create protocol packet
-	pkt := protocol.NewDataPacket(client.SessionID, data)
-	
-	// Encode packet
-	encoded := pkt.Encode()
-	
-	// Encrypt packet
-	encrypted, err := s.crypto.Encrypt(encoded)
+	counter, err := s.sendPacket(client, protocol.PacketTypeData, data)
 	if err != nil {
-		log.Printf("Failed to encrypt packet: %v", err)
+		if errors.Is(err, crypto.ErrKeyExpired) {
+			s.requestRekey(client)
+			return
+		}
+		log.Printf("Error sending to client %d: %v", client.SessionID, err)
 		return
 	}
 
-	// Send to client
-	if _, err := s.udpConn.WriteToUDP(encrypted, addr); err != nil {
-		log.Printf("Error sending to client %s: %v", addr, err)
+	if counter == crypto.RekeyAfterMessages {
+		s.requestRekey(client)
+	}
+}
+
+// requestRekey asks a client to start a new handshake. Clients rekey on
+// their own schedule; this covers keys that have aged on the server side.
+func (s *Server) requestRekey(client *Client) {
+	// Once the key is past its limits it can no longer authenticate the
+	// request; the session then times out unless the client rekeys
+	if _, err := s.sendPacket(client, protocol.PacketTypeRekey, nil); err != nil &&
+		!errors.Is(err, crypto.ErrKeyExpired) && !errors.Is(err, crypto.ErrCounterExhausted) {
+		log.Printf("Error sending rekey request to client %d: %v", client.SessionID, err)
+	}
+}
+
+// sendPacket encrypts payload with the client's current keys, binding the
+// cleartext header as associated data, and sends it. It returns the counter
+// the packet was sent with.
+func (s *Server) sendPacket(client *Client, t protocol.PacketType, payload []byte) (uint64, error) {
+	session := client.keys.Current()
+	if session == nil {
+		return 0, errors.New("no session keys")
 	}
+
+	counter, err := session.NextCounter()
+	if err != nil {
+		return 0, err
+	}
+
+	pkt := protocol.NewTransportPacket(t, client.SessionID, session.Epoch, counter, len(payload)+session.Overhead())
+	pkt.Data = session.Encrypt(counter, payload, pkt.Header.Encode())
+
+	_, err = s.udpConn.WriteToUDP(pkt.Encode(), client.endpoint())
+	return counter, err
 }
 
 // cleanupClients removes inactive clients
 func (s *Server) cleanupClients() {
 	defer s.wg.Done()
-	
+
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
@@ -311,20 +1157,59 @@ func (s *Server) cleanupClients() {
 			now := time.Now()
 			for sessionID, client := range s.clients {
 				client.mu.Lock()
-				if now.Sub(client.LastSeen) > 60*time.Second {
-					delete(s.clients, sessionID)
-					log.Printf("Client disconnected: %s (session: %d)", client.RemoteAddr, sessionID)
-				}
+				expired := now.Sub(client.LastSeen) > 60*time.Second
 				client.mu.Unlock()
+
+				if expired {
+					// The client is most likely gone, but if only its
+					// packets were lost it learns why traffic stopped
+					s.sendControl(client, &protocol.SessionError{Code: protocol.ErrorCodeSessionExpired})
+					s.deleteClientLocked(client)
+					log.Printf("Client disconnected: %s (session: %d, replays dropped: %d, spoofs dropped: %d, denied dropped: %d)",
+						client.endpoint(), sessionID, client.ReplaysDropped.Load(), client.SpoofsDropped.Load(), client.DeniedDropped.Load())
+					continue
+				}
+
+				if session := client.keys.Current(); session != nil && session.NeedsRekey() && !client.keys.Pending() {
+					s.requestRekey(client)
+				}
 			}
 			s.clientsMu.Unlock()
+
+			s.renewLeases()
 		}
 	}
 }
 
-// generateSessionID generates a random session ID
-func generateSessionID() uint32 {
-	buf := make([]byte, 4)
-	rand.Read(buf)
-	return binary.BigEndian.Uint32(buf)
+// handshakeLoad counts handshake inits per second to tell when the server is
+// under load. It is only used from the UDP read loop.
+type handshakeLoad struct {
+	limit       int
+	windowStart time.Time
+	count       int
+	wasLoaded   bool // The previous window was over the limit
+}
+
+// add counts a handshake init and reports whether the server is under load
+func (l *handshakeLoad) add() bool {
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		l.wasLoaded = l.count > l.limit
+		l.windowStart = now
+		l.count = 0
+	}
+	l.count++
+
+	if l.count == l.limit+1 && !l.wasLoaded {
+		log.Printf("Handshake load above %d/s, requiring cookies", l.limit)
+	}
+	return l.count > l.limit
+}
+
+// addrBytes encodes a UDP address for binding cookies to it
+func addrBytes(addr *net.UDPAddr) []byte {
+	buf := make([]byte, net.IPv6len+2)
+	copy(buf, addr.IP.To16())
+	binary.BigEndian.PutUint16(buf[net.IPv6len:], uint16(addr.Port))
+	return buf
 }
@@ -156,7 +156,7 @@ func setIPDarwin(name string, ip net.IP, mask net.IPMask) error {
 	// Use ifconfig command on macOS
 	ipStr := ip.String()
 	maskStr := net.IP(mask).String()
-	
+
 	cmd := exec.Command("ifconfig", name, "inet", ipStr, "netmask", maskStr)
 	return cmd.Run()
 }
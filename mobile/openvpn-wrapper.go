@@ -4,14 +4,11 @@ package main
 // This creates an OpenVPN-compatible server that wraps our VPN protocol
 
 import (
-	"encoding/base64"
 	"fmt"
 	"log"
-	"net"
 	"os"
 
 	"github.com/nees/omail/internal/crypto"
-	"github.com/nees/omail/internal/protocol"
 	"github.com/nees/omail/internal/server"
 )
 
@@ -21,18 +18,28 @@ type OpenVPNWrapper struct {
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: openvpn-wrapper <password> <port>")
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: openvpn-wrapper <key-file> <peers-file> <port>")
 		os.Exit(1)
 	}
 
-	password := os.Args[1]
-	port := os.Args[2]
+	privateKey, err := crypto.LoadPrivateKey(os.Args[1])
+	if err != nil {
+		log.Fatalf("Failed to load private key: %v", err)
+	}
+
+	peers, err := crypto.LoadPublicKeys(os.Args[2])
+	if err != nil {
+		log.Fatalf("Failed to load peers: %v", err)
+	}
+
+	port := os.Args[3]
 
 	// Create our VPN server
 	config := server.Config{
 		Address:    ":" + port,
-		Password:   password,
+		PrivateKey: privateKey,
+		Peers:      peers,
 		TUNName:    "omail0",
 		TUNIP:      "10.0.0.1",
 		TUNNetmask: "255.255.255.0",
@@ -52,12 +59,12 @@ func main() {
 	log.Println("Use OpenVPN Connect app with generated config")
 
 	// Generate OpenVPN config
-	generateOpenVPNConfig(password, port)
+	generateOpenVPNConfig(port)
 
 	select {} // Keep running
 }
 
-func generateOpenVPNConfig(password, port string) {
+func generateOpenVPNConfig(port string) {
 	// Generate OpenVPN config file
 	config := fmt.Sprintf(`client
 dev tun
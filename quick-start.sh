@@ -53,11 +53,21 @@ echo -e "${YELLOW}Step 3: Building VPN binaries...${NC}"
 mkdir -p bin
 go build -o bin/omail-server ./cmd/server
 go build -o bin/omail-client ./cmd/client
+go build -o bin/omail-keygen ./cmd/keygen
 echo -e "${GREEN}✓ Build complete!${NC}"
 echo ""
 echo "Binaries created:"
 echo "  - bin/omail-server"
 echo "  - bin/omail-client"
+echo "  - bin/omail-keygen"
+
+# Step 3b: Test keys, the same layout as "make keys"
+if [ ! -f keys/server.key ] || [ ! -f keys/client.key ]; then
+    mkdir -p keys
+    ./bin/omail-keygen -out keys/server.key > keys/server.pub
+    ./bin/omail-keygen -out keys/client.key > keys/peers
+fi
+echo -e "${GREEN}✓ Keys in keys/ (server.key, server.pub, client.key, peers)${NC}"
 
 # Step 4: Instructions
 echo ""
@@ -71,14 +81,16 @@ echo -e "${YELLOW}Terminal 1 - Start Server:${NC}"
 echo "  cd $(pwd)"
 echo "  sudo ./bin/omail-server \\"
 echo "    -address :51820 \\"
-echo "    -password test-password-123 \\"
+echo "    -key keys/server.key \\"
+echo "    -peers keys/peers \\"
 echo "    -tun-ip 10.0.0.1"
 echo ""
 echo -e "${YELLOW}Terminal 2 - Start Client:${NC}"
 echo "  cd $(pwd)"
 echo "  sudo ./bin/omail-client \\"
 echo "    -server localhost:51820 \\"
-echo "    -password test-password-123 \\"
+echo "    -key keys/client.key \\"
+echo "    -server-key \$(cat keys/server.pub) \\"
 echo "    -tun-ip 10.0.0.2"
 echo ""
 echo -e "${YELLOW}Terminal 3 - Test Connection:${NC}"
@@ -31,38 +31,49 @@ if ! command -v go &> /dev/null; then
 fi
 
 # Check if binaries exist
-if [ ! -f "./bin/omail-server" ] || [ ! -f "./bin/omail-client" ]; then
+if [ ! -f "./bin/omail-server" ] || [ ! -f "./bin/omail-client" ] || [ ! -f "./bin/omail-keygen" ]; then
     echo -e "${YELLOW}Binaries not found. Building...${NC}"
     go mod download
     go build -o bin/omail-server ./cmd/server
     go build -o bin/omail-client ./cmd/client
+    go build -o bin/omail-keygen ./cmd/keygen
     echo -e "${GREEN}Build complete!${NC}"
 fi
 
+# Generate test keys, the same layout as "make keys"
+if [ ! -f "./keys/server.key" ] || [ ! -f "./keys/client.key" ]; then
+    echo -e "${YELLOW}Keys not found. Generating...${NC}"
+    mkdir -p keys
+    ./bin/omail-keygen -out keys/server.key > keys/server.pub
+    ./bin/omail-keygen -out keys/client.key > keys/peers
+fi
+
 MODE=${1:-test}
-PASSWORD=${VPN_PASSWORD:-test-password-123}
+SERVER_KEY=$(cat keys/server.pub)
 
 case $MODE in
     server)
         echo -e "${GREEN}Starting VPN Server...${NC}"
-        echo "Password: $PASSWORD"
+        echo "Server public key: $SERVER_KEY"
         echo "Press Ctrl+C to stop"
         echo ""
         exec ./bin/omail-server \
             -address :51820 \
-            -password "$PASSWORD" \
+            -key keys/server.key \
+            -peers keys/peers \
             -tun-ip 10.0.0.1
         ;;
     client)
         SERVER=${VPN_SERVER:-localhost:51820}
         echo -e "${GREEN}Starting VPN Client...${NC}"
         echo "Server: $SERVER"
-        echo "Password: $PASSWORD"
+        echo "Server public key: $SERVER_KEY"
         echo "Press Ctrl+C to stop"
         echo ""
         exec ./bin/omail-client \
             -server "$SERVER" \
-            -password "$PASSWORD" \
+            -key keys/client.key \
+            -server-key "$SERVER_KEY" \
             -tun-ip 10.0.0.2
         ;;
     test)
@@ -79,7 +90,8 @@ case $MODE in
         echo "Starting server in background..."
         ./bin/omail-server \
             -address :51820 \
-            -password "$PASSWORD" \
+            -key keys/server.key \
+            -peers keys/peers \
             -tun-ip 10.0.0.1 &
         SERVER_PID=$!
         sleep 2
@@ -104,7 +116,8 @@ case $MODE in
         echo -e "${GREEN}Test 3: Start client${NC}"
         ./bin/omail-client \
             -server localhost:51820 \
-            -password "$PASSWORD" \
+            -key keys/client.key \
+            -server-key "$SERVER_KEY" \
             -tun-ip 10.0.0.2 &
         CLIENT_PID=$!
         sleep 3